@@ -0,0 +1,375 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// ChirpsDelete removes a deleted user's chirps
+	ChirpsDelete = "delete"
+	// ChirpsAnonymize keeps the chirps but detaches them from the user
+	ChirpsAnonymize = "anonymize"
+
+	// deletedAuthorID is the author of chirps whose user was deleted
+	deletedAuthorID = 0
+)
+
+// chirpDeletionPolicyFromEnv reads ACCOUNT_DELETION_CHIRPS
+func chirpDeletionPolicyFromEnv() (string, error) {
+	switch policy := os.Getenv("ACCOUNT_DELETION_CHIRPS"); policy {
+	case "":
+		return ChirpsDelete, nil
+	case ChirpsDelete, ChirpsAnonymize:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("ACCOUNT_DELETION_CHIRPS must be %q or %q", ChirpsDelete, ChirpsAnonymize)
+	}
+}
+
+// DeleteUser removes a user and applies the chirp policy to their chirps.
+// Reports they filed are kept for moderation but no longer name them, and
+// the moderation log no longer quotes their chirps. Outstanding tokens
+// stop working because every authenticated path looks the user up, and
+// IDs are never reused. It returns the media blobs nothing used anymore,
+// for the caller to pass to deleteUnusedBlobs.
+func (db *DB) DeleteUser(userID int, chirpPolicy string) (unusedBlobs []string, err error) {
+	var deleted []Event
+	err = db.update(func(dbStruct *DBStructure) error {
+		user, ok := dbStruct.Users[userID]
+		if !ok {
+			return fmt.Errorf("user %w", ErrNotFound)
+		}
+
+		blobs := []string{mediaKey(user.AvatarURL)}
+
+		for id, chirp := range dbStruct.Chirps {
+			if chirp.AuthorID != userID {
+				continue
+			}
+			if chirpPolicy == ChirpsAnonymize {
+				chirp.AuthorID = deletedAuthorID
+				dbStruct.Chirps[id] = chirp
+			} else {
+				delete(dbStruct.Chirps, id)
+				deleted = append(deleted, ChirpDeleted{Chirp: chirp, ActorID: userID})
+				for _, attachment := range chirp.Media {
+					blobs = append(blobs, attachment.blobKeys()...)
+				}
+			}
+		}
+		for i, action := range dbStruct.ModerationLog {
+			if action.TargetType == "chirp" && strings.HasPrefix(action.Snapshot, chirpSnapshotPrefix(userID)) {
+				dbStruct.ModerationLog[i].Snapshot = chirpSnapshotPrefix(userID) + redactedSnapshot
+			}
+		}
+		for id, report := range dbStruct.Reports {
+			if report.ReporterID == userID {
+				report.ReporterID = 0
+				dbStruct.Reports[id] = report
+			}
+		}
+		for id, endpoint := range dbStruct.WebhookEndpoints {
+			if endpoint.OwnerID == userID {
+				delete(dbStruct.WebhookEndpoints, id)
+			}
+		}
+		for id, delivery := range dbStruct.WebhookDeliveries {
+			if _, ok := dbStruct.WebhookEndpoints[delivery.EndpointID]; !ok {
+				delete(dbStruct.WebhookDeliveries, id)
+			}
+		}
+		for id, notification := range dbStruct.Notifications {
+			if notification.UserID == userID {
+				delete(dbStruct.Notifications, id)
+			}
+		}
+		for handle, redirect := range dbStruct.HandleRedirects {
+			if redirect.UserID == userID {
+				delete(dbStruct.HandleRedirects, handle)
+			}
+		}
+		delete(dbStruct.LoginAttempts, loginAttemptKeys(user.Email, "")[0])
+		delete(dbStruct.Users, userID)
+		unusedBlobs = dbStruct.unusedBlobs(blobs)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	db.publish(deleted...)
+	return unusedBlobs, nil
+}
+
+// UserExport is everything stored about a user
+type UserExport struct {
+	ExportedAt        time.Time          `json:"exported_at"`
+	Profile           User               `json:"profile"`
+	Security          map[string]bool    `json:"security"`
+	Chirps            []Chirp            `json:"chirps"`
+	Reports           []Report           `json:"reports_filed"`
+	ModerationActions []ModerationAction `json:"moderation_actions"`
+	Notifications     []Notification     `json:"notifications"`
+	WebhookEndpoints  []WebhookEndpoint  `json:"webhook_endpoints"`
+	Media             []ExportedMedia    `json:"media"`
+}
+
+// ExportedMedia is an image the user uploaded. The zip export includes
+// the files themselves.
+type ExportedMedia struct {
+	Key string `json:"key"`
+	URL string `json:"url"`
+	// ChirpID is the chirp it's attached to, 0 for the avatar
+	ChirpID int `json:"chirp_id,omitempty"`
+}
+
+// ExportUser collects a user's data. Secrets (password hash, TOTP secret,
+// recovery codes, webhook signing secrets) are not included, only whether
+// they are set.
+func (db *DB) ExportUser(userID int) (UserExport, error) {
+	dbStruct, err := db.loadDB()
+	if err != nil {
+		return UserExport{}, err
+	}
+
+	user, ok := dbStruct.Users[userID]
+	if !ok {
+		return UserExport{}, fmt.Errorf("user %w", ErrNotFound)
+	}
+
+	export := UserExport{
+		ExportedAt: time.Now().UTC(),
+		Security: map[string]bool{
+			"password_set":        user.Password != "",
+			"totp_enabled":        user.TOTPEnabled,
+			"recovery_codes_left": len(user.RecoveryCodes) > 0,
+		},
+		Chirps:            []Chirp{},
+		Reports:           []Report{},
+		ModerationActions: []ModerationAction{},
+		Notifications:     []Notification{},
+		WebhookEndpoints:  []WebhookEndpoint{},
+		Media:             []ExportedMedia{},
+	}
+	user.Password = ""
+	user.TOTPSecret = ""
+	user.TOTPLastStep = 0
+	user.RecoveryCodes = nil
+	export.Profile = user
+
+	for _, chirp := range dbStruct.Chirps {
+		if chirp.AuthorID == userID {
+			export.Chirps = append(export.Chirps, chirp)
+		}
+	}
+	sort.Slice(export.Chirps, func(i, j int) bool { return export.Chirps[i].ID < export.Chirps[j].ID })
+
+	if key := mediaKey(user.AvatarURL); key != "" {
+		export.Media = append(export.Media, ExportedMedia{Key: key, URL: mediaURL(key)})
+	}
+	for _, chirp := range export.Chirps {
+		for _, attachment := range chirp.Media {
+			export.Media = append(export.Media, ExportedMedia{Key: attachment.Key, URL: attachment.URL, ChirpID: chirp.ID})
+		}
+	}
+
+	for _, report := range dbStruct.Reports {
+		if report.ReporterID == userID {
+			export.Reports = append(export.Reports, report)
+		}
+	}
+	sort.Slice(export.Reports, func(i, j int) bool { return export.Reports[i].ID < export.Reports[j].ID })
+
+	for _, action := range dbStruct.ModerationLog {
+		if action.TargetType == "user" && action.TargetID == userID {
+			export.ModerationActions = append(export.ModerationActions, action)
+		}
+	}
+
+	for _, notification := range dbStruct.Notifications {
+		if notification.UserID == userID {
+			export.Notifications = append(export.Notifications, notification)
+		}
+	}
+	sort.Slice(export.Notifications, func(i, j int) bool { return export.Notifications[i].ID < export.Notifications[j].ID })
+
+	for _, endpoint := range dbStruct.WebhookEndpoints {
+		if endpoint.OwnerID == userID {
+			endpoint.Secret = ""
+			export.WebhookEndpoints = append(export.WebhookEndpoints, endpoint)
+		}
+	}
+	sort.Slice(export.WebhookEndpoints, func(i, j int) bool { return export.WebhookEndpoints[i].ID < export.WebhookEndpoints[j].ID })
+	return export, nil
+}
+
+func (cfg *apiConfig) handlerDeleteUser(w http.ResponseWriter, r *http.Request) {
+	userID, err := cfg.getAuthenticatedUserID(r)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	var deleteRequest struct {
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&deleteRequest); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	user, err := cfg.database.GetUserByID(userID)
+	if err != nil {
+		respondWithDBError(w, err, "User not found")
+		return
+	}
+
+	// a stolen access token mustn't give unlimited password guesses
+	attemptKeys := loginAttemptKeys(user.Email, clientIP(r))
+	if !cfg.ensureLoginAllowed(w, attemptKeys) {
+		return
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(deleteRequest.Password)); err != nil {
+		cfg.respondWithLoginFailure(w, attemptKeys, "Password is incorrect")
+		return
+	}
+	if user.TOTPEnabled {
+		if err := cfg.database.VerifySecondFactor(userID, deleteRequest.Code, ""); err != nil {
+			cfg.respondWithLoginFailure(w, attemptKeys, "Invalid two-factor code")
+			return
+		}
+	}
+
+	// the refresh token can't be found from the user, so revoke it if the
+	// client sent it along
+	if refreshToken := r.Header.Get("X-Refresh-Token"); refreshToken != "" {
+		if err := cfg.database.RevokeToken(refreshToken); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to revoke token")
+			return
+		}
+	}
+
+	unusedBlobs, err := cfg.database.DeleteUser(userID, cfg.chirpDeletionPolicy)
+	if err != nil {
+		respondWithDBError(w, err, "Failed to delete user")
+		return
+	}
+	deleteUnusedBlobs(cfg.database, cfg.blobStore, unusedBlobs)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (cfg *apiConfig) handlerExportUser(w http.ResponseWriter, r *http.Request) {
+	userID, err := cfg.getAuthenticatedUserID(r)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	export, err := cfg.database.ExportUser(userID)
+	if err != nil {
+		respondWithDBError(w, err, "Failed to export data")
+		return
+	}
+
+	filename := fmt.Sprintf("chirpy-export-%d-%s", userID, export.ExportedAt.Format("20060102"))
+	switch r.URL.Query().Get("format") {
+	case "", "json":
+		w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`.json"`)
+		respondWithJSON(w, http.StatusOK, export)
+	case "zip":
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`.zip"`)
+		w.WriteHeader(http.StatusOK)
+		if err := writeExportZip(w, export, cfg.blobStore); err != nil {
+			// headers are already sent, all we can do is log
+			log.Printf("Error writing export archive: %v", err)
+		}
+	default:
+		respondWithError(w, http.StatusBadRequest, "format must be json or zip")
+	}
+}
+
+// writeExportZip writes one JSON file per section, and the uploaded
+// images under media/
+func writeExportZip(w http.ResponseWriter, export UserExport, store BlobStore) error {
+	zw := zip.NewWriter(w)
+	files := map[string]interface{}{
+		"profile.json":            map[string]interface{}{"exported_at": export.ExportedAt, "profile": export.Profile, "security": export.Security},
+		"chirps.json":             export.Chirps,
+		"reports_filed.json":      export.Reports,
+		"moderation_actions.json": export.ModerationActions,
+		"notifications.json":      export.Notifications,
+		"webhook_endpoints.json":  export.WebhookEndpoints,
+		"media.json":              export.Media,
+	}
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		f, err := zw.CreateHeader(&zip.FileHeader{
+			Name:     name,
+			Method:   zip.Deflate,
+			Modified: export.ExportedAt,
+		})
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(files[name]); err != nil {
+			return err
+		}
+	}
+
+	written := make(map[string]bool)
+	for _, media := range export.Media {
+		if written[media.Key] {
+			continue
+		}
+		written[media.Key] = true
+		if err := writeExportBlob(zw, store, media.Key, export.ExportedAt); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// writeExportBlob copies one blob into the archive. Blobs that have gone
+// missing are left out rather than failing the whole export.
+func writeExportBlob(zw *zip.Writer, store BlobStore, key string, modified time.Time) error {
+	blob, err := store.Open(key)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+
+	f, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     "media/" + key,
+		Method:   zip.Store,
+		Modified: modified,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, blob)
+	return err
+}
@@ -13,7 +13,24 @@ type apiConfig struct {
 	mu             sync.Mutex
 	database       *DB
 	jwtSecret      string
-	polkaAPIKey    string
+	mailer         Mailer
+	baseURL        string
+	passwordPolicy passwordPolicy
+	// how many open reports hide a chirp, 0 disables hiding
+	reportHideThreshold int
+	// what happens to a deleted user's chirps, ChirpsDelete or ChirpsAnonymize
+	chirpDeletionPolicy string
+	// where uploaded images live and how large they may be
+	blobStore      BlobStore
+	maxUploadBytes int64
+	// webhookProviders are served under /api/webhooks/{provider}
+	webhookProviders map[string]*WebhookProvider
+	// chirpStream serves live chirp events at /api/chirps/stream
+	chirpStream *ChirpStream
+	// wsHub tracks WebSocket clients on /api/ws
+	wsHub *WSHub
+	// rateLimiter backs middlewareRateLimit
+	rateLimiter *RateLimiter
 }
 
 func (cfg *apiConfig) middlewareMetricsInc(next http.Handler) http.Handler {
@@ -19,6 +19,12 @@ const (
 	TokenTypeAccess TokenType = "chirpy-access"
 	// TokenTypeRefresh -
 	TokenTypeRefresh TokenType = "chirpy-refresh"
+	// TokenTypeMFA -
+	TokenTypeMFA TokenType = "chirpy-mfa"
+	// TokenTypeVerifyEmail -
+	TokenTypeVerifyEmail TokenType = "chirpy-verify-email"
+	// TokenTypePasswordReset -
+	TokenTypePasswordReset TokenType = "chirpy-password-reset"
 )
 
 // ErrNoAuthHeaderIncluded -
@@ -56,8 +62,51 @@ func MakeJWT(
 	return token.SignedString(signingKey)
 }
 
-// RefreshToken -
-func RefreshToken(tokenString, tokenSecret string) (string, error) {
+// AccessClaims are carried by access tokens
+type AccessClaims struct {
+	Role Role `json:"role,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// MakeAccessToken -
+func MakeAccessToken(user User, tokenSecret string, expiresIn time.Duration) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, AccessClaims{
+		Role: user.EffectiveRole(),
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    string(TokenTypeAccess),
+			IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
+			ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(expiresIn)),
+			Subject:   strconv.Itoa(user.ID),
+		},
+	})
+	return token.SignedString([]byte(tokenSecret))
+}
+
+// ParseAccessToken validates an access token and returns its claims
+func ParseAccessToken(tokenString, tokenSecret string) (AccessClaims, error) {
+	claims := AccessClaims{}
+	_, err := jwt.ParseWithClaims(
+		tokenString,
+		&claims,
+		func(token *jwt.Token) (interface{}, error) { return []byte(tokenSecret), nil },
+	)
+	if err != nil {
+		return AccessClaims{}, err
+	}
+	if claims.Issuer != string(TokenTypeAccess) {
+		return AccessClaims{}, errors.New("invalid issuer")
+	}
+	return claims, nil
+}
+
+// ValidateJWT -
+func ValidateJWT(tokenString, tokenSecret string) (string, error) {
+	return validateTokenOfType(tokenString, tokenSecret, TokenTypeAccess)
+}
+
+// validateTokenOfType checks the signature and issuer of a token and
+// returns its subject
+func validateTokenOfType(tokenString, tokenSecret string, tokenType TokenType) (string, error) {
 	claimsStruct := jwt.RegisteredClaims{}
 	token, err := jwt.ParseWithClaims(
 		tokenString,
@@ -77,54 +126,63 @@ func RefreshToken(tokenString, tokenSecret string) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	if issuer != string(TokenTypeRefresh) {
+	if issuer != string(tokenType) {
 		return "", errors.New("invalid issuer")
 	}
 
-	userID, err := strconv.Atoi(userIDString)
-	if err != nil {
-		return "", err
-	}
+	return userIDString, nil
+}
 
-	newToken, err := MakeJWT(
-		userID,
-		tokenSecret,
-		time.Hour,
-		TokenTypeAccess,
-	)
+// getAuthenticatedUserID validates the access token on a request and
+// returns the user it was issued to. Suspended users get ErrUserSuspended.
+func (cfg *apiConfig) getAuthenticatedUserID(r *http.Request) (int, error) {
+	tokenString, err := GetBearerToken(r.Header)
 	if err != nil {
-		return "", err
+		return 0, err
 	}
-
-	return newToken, nil
-}
-
-// ValidateJWT -
-func ValidateJWT(tokenString, tokenSecret string) (string, error) {
-	claimsStruct := jwt.RegisteredClaims{}
-	token, err := jwt.ParseWithClaims(
-		tokenString,
-		&claimsStruct,
-		func(token *jwt.Token) (interface{}, error) { return []byte(tokenSecret), nil },
-	)
+	userIDString, err := ValidateJWT(tokenString, cfg.jwtSecret)
 	if err != nil {
-		return "", err
+		return 0, err
 	}
-
-	userIDString, err := token.Claims.GetSubject()
+	userID, err := strconv.Atoi(userIDString)
 	if err != nil {
-		return "", err
+		return 0, err
 	}
+	if err := cfg.checkUserActive(userID); err != nil {
+		return 0, err
+	}
+	return userID, nil
+}
 
-	issuer, err := token.Claims.GetIssuer()
+// checkUserActive fails for users that no longer exist or are suspended
+func (cfg *apiConfig) checkUserActive(userID int) error {
+	user, err := cfg.database.GetUserByID(userID)
 	if err != nil {
-		return "", err
+		return err
 	}
-	if issuer != string(TokenTypeAccess) {
-		return "", errors.New("invalid issuer")
+	if user.Suspended {
+		return ErrUserSuspended
 	}
+	return nil
+}
 
-	return userIDString, nil
+// ensureActiveUser responds with an error and returns false if the
+// authenticated user can't use the API any more
+func (cfg *apiConfig) ensureActiveUser(w http.ResponseWriter, userID int) bool {
+	if err := cfg.checkUserActive(userID); err != nil {
+		respondWithAuthError(w, err)
+		return false
+	}
+	return true
+}
+
+// respondWithAuthError answers a failed authentication
+func respondWithAuthError(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrUserSuspended) {
+		respondWithProblem(w, http.StatusForbidden, "account_suspended", "Account suspended", nil)
+		return
+	}
+	respondWithError(w, http.StatusUnauthorized, "Invalid or expired token")
 }
 
 // GetBearerToken -
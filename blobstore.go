@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+// BlobStore keeps binary content addressed by its SHA-256 hash, so the
+// same file uploaded twice is stored once
+type BlobStore interface {
+	// Put stores data and returns its key
+	Put(data []byte) (string, error)
+	// Open returns a reader for the blob with the given key
+	Open(key string) (io.ReadSeekCloser, error)
+	// Delete removes a blob; deleting a missing blob is not an error
+	Delete(key string) error
+}
+
+var validBlobKey = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// blobKey returns the content address for data
+func blobKey(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// LocalBlobStore keeps blobs on disk under Dir, fanned out by the first
+// two characters of the key
+type LocalBlobStore struct {
+	Dir string
+}
+
+// NewLocalBlobStore creates the directory if it doesn't exist
+func NewLocalBlobStore(dir string) (*LocalBlobStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &LocalBlobStore{Dir: dir}, nil
+}
+
+func (s *LocalBlobStore) path(key string) (string, error) {
+	if !validBlobKey.MatchString(key) {
+		return "", fmt.Errorf("blob %w", ErrNotFound)
+	}
+	return filepath.Join(s.Dir, key[:2], key), nil
+}
+
+func (s *LocalBlobStore) Put(data []byte) (string, error) {
+	key := blobKey(data)
+	path, err := s.path(key)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(path); err == nil {
+		return key, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+
+	// write to a temp file first so readers never see a partial blob
+	tmp, err := os.CreateTemp(filepath.Dir(path), key+".tmp-*")
+	if err != nil {
+		return "", err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return key, nil
+}
+
+func (s *LocalBlobStore) Open(key string) (io.ReadSeekCloser, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("blob %w", ErrNotFound)
+	}
+	return f, err
+}
+
+func (s *LocalBlobStore) Delete(key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -1,16 +1,257 @@
 package main
 
-import "net/http"
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
 
-func middlewareCors(next http.Handler) http.Handler {
+	"github.com/go-chi/chi/v5"
+)
+
+// corsMethods are the methods checked against the router to answer
+// preflights
+var corsMethods = []string{
+	http.MethodGet,
+	http.MethodHead,
+	http.MethodPost,
+	http.MethodPut,
+	http.MethodPatch,
+	http.MethodDelete,
+}
+
+// CORSPolicy is who may call the API from a browser. It is read from
+// the JSON file named by CORS_CONFIG, then CORS_* variables override
+// single fields.
+type CORSPolicy struct {
+	// AllowedOrigins are exact origins like "https://chirpy.example",
+	// wildcard subdomains like "https://*.chirpy.example", or "*"
+	AllowedOrigins   []string `json:"allowed_origins"`
+	AllowCredentials bool     `json:"allow_credentials"`
+	// AllowedHeaders are request headers scripts may send. "*" allows
+	// whatever the preflight asks for.
+	AllowedHeaders []string `json:"allowed_headers"`
+	// ExposedHeaders are response headers scripts may read
+	ExposedHeaders []string `json:"exposed_headers"`
+	// MaxAge is how many seconds browsers may cache a preflight
+	MaxAge int `json:"max_age"`
+}
+
+var defaultCORSPolicy = CORSPolicy{
+	AllowedOrigins: []string{"*"},
+	AllowedHeaders: []string{"Authorization", "Content-Type", "Last-Event-ID", requestIDHeader},
+	ExposedHeaders: []string{
+		requestIDHeader,
+		"Retry-After",
+		"X-RateLimit-Limit",
+		"X-RateLimit-Remaining",
+		"X-RateLimit-Reset",
+		"Location",
+		"ETag",
+	},
+	MaxAge: 600,
+}
+
+// splitList splits a comma separated env value, dropping empty entries
+func splitList(v string) []string {
+	var items []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func corsPolicyFromEnv() (CORSPolicy, error) {
+	policy := defaultCORSPolicy
+
+	if path := os.Getenv("CORS_CONFIG"); path != "" {
+		dat, err := os.ReadFile(path)
+		if err != nil {
+			return CORSPolicy{}, fmt.Errorf("reading CORS_CONFIG: %w", err)
+		}
+		// fields missing from the file keep their defaults
+		if err := json.Unmarshal(dat, &policy); err != nil {
+			return CORSPolicy{}, fmt.Errorf("parsing CORS_CONFIG: %w", err)
+		}
+	}
+
+	for name, field := range map[string]*[]string{
+		"CORS_ALLOWED_ORIGINS": &policy.AllowedOrigins,
+		"CORS_ALLOWED_HEADERS": &policy.AllowedHeaders,
+		"CORS_EXPOSED_HEADERS": &policy.ExposedHeaders,
+	} {
+		if v := os.Getenv(name); v != "" {
+			*field = splitList(v)
+		}
+	}
+	if v := os.Getenv("CORS_ALLOW_CREDENTIALS"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return CORSPolicy{}, fmt.Errorf("CORS_ALLOW_CREDENTIALS must be true or false")
+		}
+		policy.AllowCredentials = b
+	}
+	if v := os.Getenv("CORS_MAX_AGE"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return CORSPolicy{}, fmt.Errorf("CORS_MAX_AGE must be a non-negative number of seconds")
+		}
+		policy.MaxAge = n
+	}
+
+	return policy, policy.validate()
+}
+
+func (p CORSPolicy) validate() error {
+	for _, origin := range p.AllowedOrigins {
+		if origin == "*" {
+			if p.AllowCredentials {
+				return fmt.Errorf("CORS origin \"*\" can't be combined with credentials, list the origins instead")
+			}
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || u.Scheme == "" || u.Host == "" || (u.Path != "" && u.Path != "/") || u.RawQuery != "" {
+			return fmt.Errorf("CORS origin %q must look like https://example.com", origin)
+		}
+		if strings.Contains(strings.TrimPrefix(u.Host, "*."), "*") {
+			return fmt.Errorf("CORS origin %q may only use * for the leftmost subdomain", origin)
+		}
+	}
+	return nil
+}
+
+// allowsOrigin reports whether a request Origin is on the allowlist.
+// "https://*.example.com" matches any subdomain but not example.com itself.
+func (p CORSPolicy) allowsOrigin(origin string) bool {
+	origin = strings.ToLower(origin)
+	for _, allowed := range p.AllowedOrigins {
+		allowed = strings.TrimSuffix(strings.ToLower(allowed), "/")
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+		scheme, host, ok := strings.Cut(allowed, "://*.")
+		if !ok {
+			continue
+		}
+		prefix := scheme + "://"
+		if strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, "."+host) && len(origin) > len(prefix)+len(host)+1 &&
+			isSubdomain(origin[len(prefix):len(origin)-len(host)-1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// isSubdomain reports whether s is one or more DNS labels, so a wildcard
+// can't match something like "evil.com/x.example.com"
+func isSubdomain(s string) bool {
+	for _, label := range strings.Split(s, ".") {
+		if label == "" {
+			return false
+		}
+		for _, c := range label {
+			if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (p CORSPolicy) anyOrigin() bool {
+	for _, allowed := range p.AllowedOrigins {
+		if allowed == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedHeaders answers Access-Control-Request-Headers
+func (p CORSPolicy) allowedHeaders(requested string) string {
+	for _, header := range p.AllowedHeaders {
+		if header == "*" {
+			// a literal * wouldn't cover Authorization, so echo the request
+			return requested
+		}
+	}
+	return strings.Join(p.AllowedHeaders, ", ")
+}
+
+// routeMethods lists the methods the router serves for path
+func routeMethods(routes chi.Routes, path string) []string {
+	var methods []string
+	for _, method := range corsMethods {
+		if routes.Match(chi.NewRouteContext(), method, path) {
+			methods = append(methods, method)
+		}
+	}
+	return methods
+}
+
+// middlewareCors applies policy to browser requests. Preflights are
+// answered with the methods routes actually serves for the path; those
+// for paths that don't exist fall through to the router like any other
+// OPTIONS request.
+func middlewareCors(policy CORSPolicy, routes chi.Routes, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS, PUT, DELETE")
-		w.Header().Set("Access-Control-Allow-Headers", "*")
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(http.StatusOK)
+		w.Header().Add("Vary", "Origin")
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		allowed := policy.allowsOrigin(origin)
+
+		requestMethod := r.Header.Get("Access-Control-Request-Method")
+		if r.Method != http.MethodOptions || requestMethod == "" {
+			if allowed {
+				policy.setOriginHeaders(w, origin)
+				if len(policy.ExposedHeaders) > 0 {
+					w.Header().Set("Access-Control-Expose-Headers", strings.Join(policy.ExposedHeaders, ", "))
+				}
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// preflight
+		w.Header().Add("Vary", "Access-Control-Request-Method")
+		w.Header().Add("Vary", "Access-Control-Request-Headers")
+		methods := routeMethods(routes, r.URL.Path)
+		if len(methods) == 0 {
+			next.ServeHTTP(w, r)
 			return
 		}
-		next.ServeHTTP(w, r)
+		if !allowed {
+			respondWithProblem(w, http.StatusForbidden, "cors_origin_not_allowed", "Origin not allowed", nil)
+			return
+		}
+		policy.setOriginHeaders(w, origin)
+		w.Header().Set("Access-Control-Allow-Methods", strings.Join(append(methods, http.MethodOptions), ", "))
+		if requested := r.Header.Get("Access-Control-Request-Headers"); requested != "" {
+			w.Header().Set("Access-Control-Allow-Headers", policy.allowedHeaders(requested))
+		}
+		if policy.MaxAge > 0 {
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(policy.MaxAge))
+		}
+		w.WriteHeader(http.StatusNoContent)
 	})
 }
+
+func (p CORSPolicy) setOriginHeaders(w http.ResponseWriter, origin string) {
+	if p.anyOrigin() {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	} else {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+	}
+	if p.AllowCredentials {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import "testing"
+
+func TestCORSPolicyAllowsOrigin(t *testing.T) {
+	wildcard := CORSPolicy{AllowedOrigins: []string{"https://*.example.com"}}
+	exact := CORSPolicy{AllowedOrigins: []string{"https://chirpy.example", "http://localhost:8080/"}}
+	anyOrigin := CORSPolicy{AllowedOrigins: []string{"*"}}
+
+	tests := []struct {
+		name   string
+		policy CORSPolicy
+		origin string
+		want   bool
+	}{
+		{"wildcard subdomain", wildcard, "https://app.example.com", true},
+		{"wildcard nested subdomain", wildcard, "https://a.b.example.com", true},
+		{"wildcard is case-insensitive", wildcard, "https://App.Example.COM", true},
+		{"wildcard excludes the bare domain", wildcard, "https://example.com", false},
+		{"wildcard empty label", wildcard, "https://.example.com", false},
+		{"wildcard lookalike domain", wildcard, "https://evil-example.com", false},
+		{"wildcard as a prefix of another domain", wildcard, "https://example.com.evil.com", false},
+		{"wildcard wrong scheme", wildcard, "http://app.example.com", false},
+		{"wildcard with a port", wildcard, "https://app.example.com:8443", false},
+		{"wildcard path trick", wildcard, "https://evil.com/x.example.com", false},
+		{"wildcard userinfo trick", wildcard, "https://evil.com@x.example.com", false},
+		{"wildcard null origin", wildcard, "null", false},
+		{"wildcard empty origin", wildcard, "", false},
+
+		{"exact match", exact, "https://chirpy.example", true},
+		{"exact match ignores a trailing slash on the allowlist", exact, "http://localhost:8080", true},
+		{"exact wrong scheme", exact, "http://chirpy.example", false},
+		{"exact wrong port", exact, "http://localhost:8081", false},
+		{"exact missing port", exact, "http://localhost", false},
+		{"exact subdomain", exact, "https://www.chirpy.example", false},
+		{"exact null origin", exact, "null", false},
+
+		{"any origin", anyOrigin, "https://anything.test", true},
+		{"no origins", CORSPolicy{}, "https://chirpy.example", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.allowsOrigin(tt.origin); got != tt.want {
+				t.Fatalf("allowsOrigin(%q) with %v = %v, want %v", tt.origin, tt.policy.AllowedOrigins, got, tt.want)
+			}
+		})
+	}
+}
@@ -6,34 +6,130 @@ import (
 	"log"
 	"os"
 	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	"golang.org/x/crypto/bcrypt"
 )
 
 type Chirp struct {
-	AuthorID int    `json:"author_id"`
-	Body     string `json:"body"`
-	ID       int    `json:"id"`
+	AuthorID  int        `json:"author_id"`
+	Body      string     `json:"body"`
+	ID        int        `json:"id"`
+	CreatedAt time.Time  `json:"created_at"`
+	EditedAt  *time.Time `json:"edited_at,omitempty"`
+	// Hidden chirps were taken out of public view by reports or a moderator
+	Hidden bool `json:"hidden,omitempty"`
+	// Media holds up to maxChirpMedia attached images
+	Media []Attachment `json:"media,omitempty"`
 }
 
 type DB struct {
 	Path string
 	Mux  *sync.RWMutex
+	// TxMux serialises read-modify-write cycles made through update,
+	// so checks like email uniqueness can't race each other
+	TxMux *sync.Mutex
+	// BlobMux is held shared from storing a blob until the reference to
+	// it is written, and exclusively while deleting unreferenced blobs,
+	// so an upload that dedups to an existing blob can't lose it
+	BlobMux *sync.RWMutex
+	// Events receives domain events after successful writes, may be nil
+	Events *EventBus
 }
 
 type DBStructure struct {
-	Chirps      map[int]Chirp         `json:"chirps"`
-	Users       map[int]User          `json:"users"`
-	Revocations map[string]Revocation `json:"revocations"`
+	Chirps          map[int]Chirp             `json:"chirps"`
+	Users           map[int]User              `json:"users"`
+	Revocations     map[string]Revocation     `json:"revocations"`
+	LoginAttempts   map[string]LoginAttempt   `json:"login_attempts"`
+	UsedTokens      map[string]time.Time      `json:"used_tokens"`
+	ModerationLog   []ModerationAction        `json:"moderation_log"`
+	Reports         map[int]Report            `json:"reports"`
+	HandleRedirects map[string]HandleRedirect `json:"handle_redirects"`
+	WebhookEvents   map[string]WebhookEvent   `json:"webhook_events"`
+	// outbound webhooks
+	WebhookEndpoints  map[int]WebhookEndpoint `json:"webhook_endpoints"`
+	WebhookDeliveries map[int]WebhookDelivery `json:"webhook_deliveries"`
+	Notifications     map[int]Notification    `json:"notifications"`
+	// IDs are never reused, so tokens and links to a deleted record
+	// can't end up pointing at a new one
+	LastUserID         int `json:"last_user_id"`
+	LastChirpID        int `json:"last_chirp_id"`
+	LastEndpointID     int `json:"last_endpoint_id"`
+	LastDeliveryID     int `json:"last_delivery_id"`
+	LastNotificationID int `json:"last_notification_id"`
+}
+
+// initMaps makes sure every collection is usable, so database files
+// written before a collection existed still load cleanly
+func (s *DBStructure) initMaps() {
+	if s.Chirps == nil {
+		s.Chirps = make(map[int]Chirp)
+	}
+	if s.Users == nil {
+		s.Users = make(map[int]User)
+	}
+	if s.Revocations == nil {
+		s.Revocations = make(map[string]Revocation)
+	}
+	if s.LoginAttempts == nil {
+		s.LoginAttempts = make(map[string]LoginAttempt)
+	}
+	if s.UsedTokens == nil {
+		s.UsedTokens = make(map[string]time.Time)
+	}
+	if s.Reports == nil {
+		s.Reports = make(map[int]Report)
+	}
+	if s.HandleRedirects == nil {
+		s.HandleRedirects = make(map[string]HandleRedirect)
+	}
+	if s.WebhookEvents == nil {
+		s.WebhookEvents = make(map[string]WebhookEvent)
+	}
+	if s.WebhookEndpoints == nil {
+		s.WebhookEndpoints = make(map[int]WebhookEndpoint)
+	}
+	if s.WebhookDeliveries == nil {
+		s.WebhookDeliveries = make(map[int]WebhookDelivery)
+	}
+	if s.Notifications == nil {
+		s.Notifications = make(map[int]Notification)
+	}
+}
+
+// nextUserID allocates a user ID
+func (s *DBStructure) nextUserID() int {
+	if s.LastUserID == 0 {
+		for id := range s.Users {
+			s.LastUserID = max(s.LastUserID, id)
+		}
+	}
+	s.LastUserID++
+	return s.LastUserID
+}
+
+// nextChirpID allocates a chirp ID
+func (s *DBStructure) nextChirpID() int {
+	if s.LastChirpID == 0 {
+		for id := range s.Chirps {
+			s.LastChirpID = max(s.LastChirpID, id)
+		}
+	}
+	s.LastChirpID++
+	return s.LastChirpID
 }
 
 // NewDB creates a new database connection
 // and creates the database file if it doesn't exist
 func NewDB(path string) (*DB, error) {
 	db := &DB{
-		Path: path,
-		Mux:  &sync.RWMutex{},
+		Path:    path,
+		Mux:     &sync.RWMutex{},
+		TxMux:   &sync.Mutex{},
+		BlobMux: &sync.RWMutex{},
 	}
 	if err := db.ensureDB(); err != nil {
 		return nil, err
@@ -41,51 +137,97 @@ func NewDB(path string) (*DB, error) {
 	return db, nil
 }
 
-// Create new user in DB
-func (db *DB) CreateUser(email, password string) (User, error) {
+// update loads the database, applies fn and writes the result while
+// holding TxMux. Nothing is written if fn returns an error.
+func (db *DB) update(fn func(dbStruct *DBStructure) error) error {
+	db.TxMux.Lock()
+	defer db.TxMux.Unlock()
 
 	dbStruct, err := db.loadDB()
 	if err != nil {
-		return User{}, err
+		return err
 	}
+	if err := fn(&dbStruct); err != nil {
+		return err
+	}
+	return db.writeDB(dbStruct)
+}
+
+// ErrEmailTaken -
+var ErrEmailTaken = fmt.Errorf("email already in use: %w", ErrConflict)
 
-	for _, user := range dbStruct.Users {
-		if user.Email == email {
-			return User{}, fmt.Errorf("email already in use")
+// checkEmailAvailable fails if a user other than exceptID owns the email
+func (s *DBStructure) checkEmailAvailable(email string, exceptID int) error {
+	for _, user := range s.Users {
+		if user.ID != exceptID && strings.EqualFold(user.Email, email) {
+			return ErrEmailTaken
 		}
 	}
+	return nil
+}
 
+// Create new user in DB. handle is optional.
+func (db *DB) CreateUser(email, password, handle string) (User, error) {
+	// hash outside the transaction, bcrypt is slow
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
 		return User{}, err
 	}
 
-	newID := len(dbStruct.Users) + 1 // might need to change this implementation
-	newUser := User{ID: newID, Email: email, Password: string(hashedPassword)}
-	dbStruct.Users[newID] = newUser
+	var newUser User
+	err = db.update(func(dbStruct *DBStructure) error {
+		if err := dbStruct.checkEmailAvailable(email, 0); err != nil {
+			return err
+		}
+		if handle != "" {
+			dbStruct.pruneHandleRedirects(time.Now().UTC())
+			if err := dbStruct.checkHandleAvailable(handle, 0); err != nil {
+				return err
+			}
+		}
 
-	if err := db.writeDB(dbStruct); err != nil {
+		newID := dbStruct.nextUserID()
+		newUser = User{
+			ID:        newID,
+			Email:     email,
+			Handle:    handle,
+			Password:  string(hashedPassword),
+			CreatedAt: time.Now().UTC(),
+		}
+		dbStruct.Users[newID] = newUser
+		return nil
+	})
+	if err != nil {
 		return User{}, err
 	}
+	db.publish(UserCreated{User: newUser})
 	return newUser, nil
 }
 
-// CreateChirp creates a new chirp and saves it to disk
-func (db *DB) CreateChirp(body string, userID int) (Chirp, error) {
-	dbStruct, err := db.loadDB()
-	if err != nil {
+// CreateChirp creates a new chirp and saves it to disk, enforcing the
+// author's plan limits
+func (db *DB) CreateChirp(body string, userID int, limits Entitlements) (Chirp, error) {
+	if err := limits.checkChirpLength(body); err != nil {
 		return Chirp{}, err
 	}
 
-	// generate ID
-	newID := len(dbStruct.Chirps) + 1
-	newChirp := Chirp{ID: newID, Body: body, AuthorID: userID}
-	dbStruct.Chirps[newID] = newChirp
-
-	if err := db.writeDB(dbStruct); err != nil {
+	var newChirp Chirp
+	err := db.update(func(dbStruct *DBStructure) error {
+		now := time.Now().UTC()
+		if limits.ChirpsPerHour > 0 && dbStruct.countRecentChirps(userID, now.Add(-time.Hour)) >= limits.ChirpsPerHour {
+			return ErrQuotaExceeded
+		}
+		// generate ID
+		newID := dbStruct.nextChirpID()
+		newChirp = Chirp{ID: newID, Body: body, AuthorID: userID, CreatedAt: now}
+		dbStruct.Chirps[newID] = newChirp
+		return nil
+	})
+	if err != nil {
 		return Chirp{}, err
 	}
 
+	db.publish(ChirpCreated{Chirp: newChirp})
 	return newChirp, nil
 }
 
@@ -111,7 +253,7 @@ func (db *DB) GetChirpByID(id int) (Chirp, error) {
 
 	chirp, ok := dbStruct.Chirps[id]
 	if !ok {
-		return Chirp{}, fmt.Errorf("chirp not found")
+		return Chirp{}, fmt.Errorf("chirp %w", ErrNotFound)
 	}
 
 	return chirp, nil
@@ -125,6 +267,9 @@ func (db *DB) GetChirpsFilteredAndSorted(authorID int, sorting string) ([]Chirp,
 
 	var chirps []Chirp
 	for _, chirp := range dbStruct.Chirps {
+		if chirp.Hidden {
+			continue
+		}
 		if authorID == 0 || chirp.AuthorID == authorID { // Filter by authorID if provided
 			chirps = append(chirps, chirp)
 		}
@@ -148,11 +293,8 @@ func (db *DB) ensureDB() error {
 	log.Println("Ensuring database exists...")
 
 	if _, err := os.Stat(db.Path); os.IsNotExist(err) {
-		initialDB := DBStructure{
-			Chirps:      make(map[int]Chirp),
-			Users:       make(map[int]User),
-			Revocations: make(map[string]Revocation),
-		}
+		initialDB := DBStructure{}
+		initialDB.initMaps()
 		return db.writeDB(initialDB)
 	}
 	return nil
@@ -172,6 +314,7 @@ func (db *DB) loadDB() (DBStructure, error) {
 	if err := json.Unmarshal(bytes, &dbStruct); err != nil {
 		return DBStructure{}, err
 	}
+	dbStruct.initMaps()
 
 	return dbStruct, nil
 }
@@ -195,47 +338,116 @@ func (db *DB) writeDB(dbStructure DBStructure) error {
 	return err
 }
 
-func (db *DB) UpdateUser(id int, email, hashedPassword string) error {
-	dbStruct, err := db.loadDB()
-	if err != nil {
-		return err
-	}
+// UserUpdate holds the fields to change on a user. Empty strings and nil
+// pointers leave the stored value unchanged.
+type UserUpdate struct {
+	Email          string
+	HashedPassword string
+	Handle         *string
+	DisplayName    *string
+	Bio            *string
+	AvatarURL      *string
+}
 
-	// Check if the user exists
-	user, exists := dbStruct.Users[id]
-	if !exists {
-		return fmt.Errorf("user not found")
-	}
+// UpdateUser applies a UserUpdate
+func (db *DB) UpdateUser(id int, update UserUpdate) (User, error) {
+	email, hashedPassword := update.Email, update.HashedPassword
+	var user User
+	err := db.update(func(dbStruct *DBStructure) error {
+		// Check if the user exists
+		var exists bool
+		user, exists = dbStruct.Users[id]
+		if !exists {
+			return fmt.Errorf("user %w", ErrNotFound)
+		}
 
-	// Update the user's details
-	user.Email = email
-	if hashedPassword != "" {
-		user.Password = hashedPassword
+		// Update the user's details; a new address has to be verified again
+		if email != "" && user.Email != email {
+			if err := dbStruct.checkEmailAvailable(email, id); err != nil {
+				return err
+			}
+			user.Email = email
+			user.EmailVerified = false
+		}
+		if hashedPassword != "" {
+			user.Password = hashedPassword
+		}
+		if update.Handle != nil {
+			if err := dbStruct.setHandle(&user, *update.Handle); err != nil {
+				return err
+			}
+		}
+		if update.DisplayName != nil {
+			user.DisplayName = *update.DisplayName
+		}
+		if update.Bio != nil {
+			user.Bio = *update.Bio
+		}
+		if update.AvatarURL != nil {
+			user.AvatarURL = *update.AvatarURL
+		}
+		dbStruct.Users[id] = user
+		return nil
+	})
+	if err != nil {
+		return User{}, err
 	}
-	dbStruct.Users[id] = user
-
-	return db.writeDB(dbStruct)
+	return user, nil
 }
 
-func (db *DB) DeleteChirp(chirpID int) error {
+// GetUserByID returns the user with the given ID
+func (db *DB) GetUserByID(id int) (User, error) {
 	dbStruct, err := db.loadDB()
 	if err != nil {
-		return fmt.Errorf("loading database: %v", err)
+		return User{}, err
 	}
 
-	// Check if the chirp exists
-	_, exists := dbStruct.Chirps[chirpID]
-	if !exists {
-		return fmt.Errorf("chirp not found")
+	user, ok := dbStruct.Users[id]
+	if !ok {
+		return User{}, fmt.Errorf("user %w", ErrNotFound)
+	}
+	return user, nil
+}
+
+// modifyUser applies fn to the stored user and saves the result
+func (db *DB) modifyUser(id int, fn func(user *User) error) (User, error) {
+	var user User
+	err := db.update(func(dbStruct *DBStructure) error {
+		var ok bool
+		user, ok = dbStruct.Users[id]
+		if !ok {
+			return fmt.Errorf("user %w", ErrNotFound)
+		}
+		if err := fn(&user); err != nil {
+			return err
+		}
+		dbStruct.Users[id] = user
+		return nil
+	})
+	if err != nil {
+		return User{}, err
 	}
+	return user, nil
+}
 
-	// Delete the chirp from the map
-	delete(dbStruct.Chirps, chirpID)
+func (db *DB) DeleteChirp(chirpID int) error {
+	var chirp Chirp
+	err := db.update(func(dbStruct *DBStructure) error {
+		// Check if the chirp exists
+		var exists bool
+		chirp, exists = dbStruct.Chirps[chirpID]
+		if !exists {
+			return fmt.Errorf("chirp %w", ErrNotFound)
+		}
 
-	// Write the updated database structure back to the file
-	if err := db.writeDB(dbStruct); err != nil {
-		return fmt.Errorf("writing database: %v", err)
+		// Delete the chirp from the map
+		delete(dbStruct.Chirps, chirpID)
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 
+	db.publish(ChirpDeleted{Chirp: chirp, ActorID: chirp.AuthorID})
 	return nil
 }
@@ -35,11 +35,14 @@ func (cfg *apiConfig) handlerDeleteChirp(w http.ResponseWriter, r *http.Request)
 		respondWithError(w, http.StatusBadRequest, "Invalid user ID")
 		return
 	}
+	if !cfg.ensureActiveUser(w, userID) {
+		return
+	}
 
 	// Retrieve chirp to check if user is author
 	chirp, err := cfg.database.GetChirpByID(chirpID)
 	if err != nil {
-		respondWithError(w, http.StatusNotFound, "Chirp not found")
+		respondWithDBError(w, err, "Chirp not found")
 		return
 	}
 
@@ -52,7 +55,7 @@ func (cfg *apiConfig) handlerDeleteChirp(w http.ResponseWriter, r *http.Request)
 	// Delete chirp
 	err = cfg.database.DeleteChirp(chirpID)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Failed to delete chirp")
+		respondWithDBError(w, err, "Failed to delete chirp")
 		return
 	}
 
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// ErrEditWindowClosed -
+var ErrEditWindowClosed = fmt.Errorf("edit window has closed: %w", ErrForbidden)
+
+// EditChirp replaces the body of a chirp if its author is still inside
+// their plan's edit window
+func (db *DB) EditChirp(chirpID, userID int, body string, limits Entitlements) (Chirp, error) {
+	if err := limits.checkChirpLength(body); err != nil {
+		return Chirp{}, err
+	}
+
+	var chirp Chirp
+	err := db.update(func(dbStruct *DBStructure) error {
+		var ok bool
+		chirp, ok = dbStruct.Chirps[chirpID]
+		if !ok || chirp.Hidden {
+			return fmt.Errorf("chirp %w", ErrNotFound)
+		}
+		if chirp.AuthorID != userID {
+			return fmt.Errorf("not the author: %w", ErrForbidden)
+		}
+		now := time.Now().UTC()
+		if now.Sub(chirp.CreatedAt) > limits.EditWindow {
+			return ErrEditWindowClosed
+		}
+		chirp.Body = body
+		chirp.EditedAt = &now
+		dbStruct.Chirps[chirpID] = chirp
+		return nil
+	})
+	return chirp, err
+}
+
+func (cfg *apiConfig) handlerEditChirp(w http.ResponseWriter, r *http.Request) {
+	chirpID, err := strconv.Atoi(chi.URLParam(r, "chirpID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid chirp ID")
+		return
+	}
+	userID, err := cfg.getAuthenticatedUserID(r)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	var editRequest struct {
+		Body string `json:"body"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&editRequest); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	_, limits, err := cfg.entitlementsFor(userID)
+	if err != nil {
+		respondWithDBError(w, err, "User not found")
+		return
+	}
+	if limits.EditWindow == 0 {
+		respondWithPlanRequired(w, "Editing chirps")
+		return
+	}
+
+	chirp, err := cfg.database.EditChirp(chirpID, userID, cleanChirpContent(editRequest.Body), limits)
+	switch {
+	case errors.Is(err, ErrEditWindowClosed):
+		respondWithProblem(w, http.StatusForbidden, "edit_window_closed",
+			fmt.Sprintf("Chirps can only be edited for %s after posting", limits.EditWindow), nil)
+		return
+	case errors.Is(err, ErrForbidden):
+		respondWithError(w, http.StatusForbidden, "User is not the author of the chirp")
+		return
+	case errors.Is(err, ErrNotFound):
+		respondWithError(w, http.StatusNotFound, "Chirp not found")
+		return
+	case err != nil:
+		respondWithChirpError(w, err, limits)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, chirp)
+}
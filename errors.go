@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+)
+
+// Sentinel errors returned by DB methods. Wrap them with %w to add context
+// and match with errors.Is.
+var (
+	// ErrNotFound -
+	ErrNotFound = errors.New("not found")
+	// ErrConflict -
+	ErrConflict = errors.New("conflict")
+	// ErrForbidden -
+	ErrForbidden = errors.New("forbidden")
+	// ErrInvalidInput -
+	ErrInvalidInput = errors.New("invalid input")
+)
+
+const requestIDHeader = "X-Request-Id"
+
+type contextKey string
+
+const requestIDKey contextKey = "request_id"
+
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// Problem is an RFC 7807 problem details body. Code is a stable machine
+// readable identifier; Detail is meant for humans and may change.
+type Problem struct {
+	Type      string      `json:"type"`
+	Title     string      `json:"title"`
+	Status    int         `json:"status"`
+	Code      string      `json:"code"`
+	Detail    string      `json:"detail,omitempty"`
+	RequestID string      `json:"request_id,omitempty"`
+	Fields    FieldErrors `json:"fields,omitempty"`
+	// Error repeats Detail for clients written against the old format
+	Error string `json:"error"`
+}
+
+// statusCodes are the default problem codes for each status
+var statusCodes = map[int]string{
+	http.StatusBadRequest:            "bad_request",
+	http.StatusUnauthorized:          "unauthorized",
+	http.StatusForbidden:             "forbidden",
+	http.StatusNotFound:              "not_found",
+	http.StatusMethodNotAllowed:      "method_not_allowed",
+	http.StatusConflict:              "conflict",
+	http.StatusRequestEntityTooLarge: "payload_too_large",
+	http.StatusUnsupportedMediaType:  "unsupported_media_type",
+	http.StatusUnprocessableEntity:   "validation_failed",
+	http.StatusTooManyRequests:       "too_many_requests",
+	http.StatusInternalServerError:   "internal_error",
+	http.StatusServiceUnavailable:    "service_unavailable",
+}
+
+// errorStatus maps sentinel errors to an HTTP status
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrConflict):
+		return http.StatusConflict
+	case errors.Is(err, ErrForbidden):
+		return http.StatusForbidden
+	case errors.Is(err, ErrInvalidInput):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrQuotaExceeded):
+		return http.StatusTooManyRequests
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// middlewareRequestID tags every request with an ID that is echoed in
+// the response headers and in problem bodies
+func middlewareRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(requestIDHeader)
+		if !validRequestID.MatchString(requestID) {
+			requestID = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, requestID)
+		ctx := context.WithValue(r.Context(), requestIDKey, requestID)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+// respondWithProblem writes an application/problem+json response.
+// An empty code falls back to the default for the status.
+func respondWithProblem(w http.ResponseWriter, status int, code, detail string, fields FieldErrors) {
+	if code == "" {
+		code = statusCodes[status]
+		if code == "" {
+			code = "error"
+		}
+	}
+	requestID := w.Header().Get(requestIDHeader)
+	if status > 499 {
+		log.Printf("Responding with 5XX error: %s (request %s)", detail, requestID)
+	}
+
+	dat, err := json.Marshal(Problem{
+		Type:      "about:blank",
+		Title:     http.StatusText(status),
+		Status:    status,
+		Code:      code,
+		Detail:    detail,
+		RequestID: requestID,
+		Fields:    fields,
+		Error:     detail,
+	})
+	if err != nil {
+		log.Printf("Error marshalling JSON: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	w.Write(dat)
+}
+
+// respondWithDBError picks the status from a DB error. detail is used for
+// the response body so internal error text doesn't leak to clients.
+func respondWithDBError(w http.ResponseWriter, err error, detail string) {
+	status := errorStatus(err)
+	if status > 499 {
+		log.Printf("Database error: %v", err)
+	}
+	respondWithProblem(w, status, "", detail, nil)
+}
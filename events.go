@@ -0,0 +1,177 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Event names, also used as outbound webhook event types
+const (
+	EventChirpCreated      = "chirp.created"
+	EventChirpDeleted      = "chirp.deleted"
+	EventUserCreated       = "user.created"
+	EventUserUpgraded      = "user.upgraded"
+	EventUserDowngraded    = "user.downgraded"
+	EventTokenRevoked      = "token.revoked"
+	EventNotificationAdded = "notification.added"
+	// EventAll subscribes to every event
+	EventAll = "*"
+)
+
+// asyncQueueSize is how many events an async subscriber can fall behind
+// before new ones are dropped
+const asyncQueueSize = 256
+
+// Event is something that happened in the DB layer
+type Event interface {
+	EventName() string
+}
+
+// ChirpCreated is published after a chirp is saved
+type ChirpCreated struct {
+	Chirp Chirp
+}
+
+// ChirpDeleted is published after a chirp is removed. ActorID is who
+// removed it: the author, a moderator, or the author deleting their account.
+type ChirpDeleted struct {
+	Chirp   Chirp
+	ActorID int
+}
+
+// UserCreated is published after a user registers
+type UserCreated struct {
+	User User
+}
+
+// UserUpgraded is published when a user gets Chirpy Red
+type UserUpgraded struct {
+	User User
+}
+
+// UserDowngraded is published when a user loses Chirpy Red, either from
+// Polka or because their paid period lapsed
+type UserDowngraded struct {
+	User User
+}
+
+// TokenRevoked is published after a refresh token is revoked. Only a
+// hash of the token goes out, subscribers have no use for a credential.
+type TokenRevoked struct {
+	// TokenHash is the hex SHA-256 of the token, see refreshTokenHash
+	TokenHash string
+	RevokedAt time.Time
+}
+
+// NotificationAdded is published when a notification is created or a
+// grouped one gets another event
+type NotificationAdded struct {
+	Notification Notification `json:"notification"`
+	UnreadCount  int          `json:"unread_count"`
+}
+
+func (ChirpCreated) EventName() string      { return EventChirpCreated }
+func (ChirpDeleted) EventName() string      { return EventChirpDeleted }
+func (UserCreated) EventName() string       { return EventUserCreated }
+func (UserUpgraded) EventName() string      { return EventUserUpgraded }
+func (UserDowngraded) EventName() string    { return EventUserDowngraded }
+func (TokenRevoked) EventName() string      { return EventTokenRevoked }
+func (NotificationAdded) EventName() string { return EventNotificationAdded }
+
+// EventBus delivers events to subscribers in-process. Synchronous
+// subscribers run before Publish returns; async ones get their own
+// goroutine and see events in order.
+type EventBus struct {
+	mu    sync.RWMutex
+	sync  map[string][]func(Event)
+	async map[string][]chan Event
+	wg    sync.WaitGroup
+}
+
+// NewEventBus -
+func NewEventBus() *EventBus {
+	return &EventBus{
+		sync:  make(map[string][]func(Event)),
+		async: make(map[string][]chan Event),
+	}
+}
+
+// Subscribe runs fn for every event with the given name (or EventAll) in
+// the publishing goroutine. Keep it quick, the write that caused the
+// event is waiting for it.
+func (b *EventBus) Subscribe(name string, fn func(Event)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.sync[name] = append(b.sync[name], fn)
+}
+
+// SubscribeAsync runs fn for every event with the given name (or
+// EventAll) on a goroutine of its own
+func (b *EventBus) SubscribeAsync(name string, fn func(Event)) {
+	queue := make(chan Event, asyncQueueSize)
+	b.mu.Lock()
+	b.async[name] = append(b.async[name], queue)
+	b.mu.Unlock()
+
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		for event := range queue {
+			runSubscriber(fn, event)
+		}
+	}()
+}
+
+// Publish hands an event to its subscribers. A nil bus drops events, so
+// a DB without one still works.
+func (b *EventBus) Publish(event Event) {
+	if b == nil {
+		return
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for _, name := range []string{event.EventName(), EventAll} {
+		for _, fn := range b.sync[name] {
+			runSubscriber(fn, event)
+		}
+		for _, queue := range b.async[name] {
+			select {
+			case queue <- event:
+			default:
+				log.Printf("Event queue full, dropping %s", event.EventName())
+			}
+		}
+	}
+}
+
+// Close stops async subscribers once they have handled queued events
+func (b *EventBus) Close() {
+	b.mu.Lock()
+	for name, queues := range b.async {
+		for _, queue := range queues {
+			close(queue)
+		}
+		delete(b.async, name)
+	}
+	b.mu.Unlock()
+	b.wg.Wait()
+}
+
+// runSubscriber keeps a failing subscriber from taking down the caller
+func runSubscriber(fn func(Event), event Event) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Event subscriber for %s panicked: %v", event.EventName(), r)
+		}
+	}()
+	fn(event)
+}
+
+// publish sends events after a successful write
+func (db *DB) publish(events ...Event) {
+	for _, event := range events {
+		db.Events.Publish(event)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// handleRedirectGrace is how long an old handle keeps pointing at its
+// owner after a change. Nobody else can claim it during that time.
+const handleRedirectGrace = 30 * 24 * time.Hour
+
+var validHandle = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]{2,14}$`)
+
+// reservedHandles can't be registered because they would be confusing
+// or clash with routes
+var reservedHandles = map[string]bool{
+	"admin":         true,
+	"administrator": true,
+	"api":           true,
+	"app":           true,
+	"chirpy":        true,
+	"help":          true,
+	"login":         true,
+	"logout":        true,
+	"me":            true,
+	"moderator":     true,
+	"mod":           true,
+	"null":          true,
+	"root":          true,
+	"settings":      true,
+	"staff":         true,
+	"support":       true,
+	"system":        true,
+	"undefined":     true,
+}
+
+// ErrHandleTaken -
+var ErrHandleTaken = fmt.Errorf("handle already in use: %w", ErrConflict)
+
+// HandleRedirect points an old handle at the user who gave it up
+type HandleRedirect struct {
+	UserID    int       `json:"user_id"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// handleKey is the case-insensitive form handles are compared by
+func handleKey(handle string) string {
+	return strings.ToLower(strings.TrimPrefix(strings.TrimSpace(handle), "@"))
+}
+
+// normalizeHandle validates a requested handle, keeping the user's casing
+func normalizeHandle(handle string) (string, error) {
+	handle = strings.TrimPrefix(strings.TrimSpace(handle), "@")
+	if handle == "" {
+		return "", fmt.Errorf("is required")
+	}
+	if !validHandle.MatchString(handle) {
+		return "", fmt.Errorf("must be 3-15 letters, digits or underscores and start with a letter")
+	}
+	if reservedHandles[strings.ToLower(handle)] {
+		return "", fmt.Errorf("is reserved")
+	}
+	return handle, nil
+}
+
+// pruneHandleRedirects drops redirects whose grace period is over
+func (s *DBStructure) pruneHandleRedirects(now time.Time) {
+	for key, redirect := range s.HandleRedirects {
+		if !redirect.ExpiresAt.After(now) {
+			delete(s.HandleRedirects, key)
+		}
+	}
+}
+
+// checkHandleAvailable fails if the handle belongs to, or is still
+// redirecting to, a user other than userID
+func (s *DBStructure) checkHandleAvailable(handle string, userID int) error {
+	key := handleKey(handle)
+	for _, user := range s.Users {
+		if user.ID != userID && handleKey(user.Handle) == key {
+			return ErrHandleTaken
+		}
+	}
+	if redirect, ok := s.HandleRedirects[key]; ok && redirect.UserID != userID {
+		return ErrHandleTaken
+	}
+	return nil
+}
+
+// setHandle changes a user's handle inside a transaction, leaving a
+// redirect behind for the old one
+func (s *DBStructure) setHandle(user *User, handle string) error {
+	now := time.Now().UTC()
+	s.pruneHandleRedirects(now)
+	if handleKey(user.Handle) == handleKey(handle) {
+		// only the casing changed
+		user.Handle = handle
+		return nil
+	}
+	if err := s.checkHandleAvailable(handle, user.ID); err != nil {
+		return err
+	}
+	if user.Handle != "" {
+		s.HandleRedirects[handleKey(user.Handle)] = HandleRedirect{
+			UserID:    user.ID,
+			ExpiresAt: now.Add(handleRedirectGrace),
+		}
+	}
+	delete(s.HandleRedirects, handleKey(handle))
+	user.Handle = handle
+	return nil
+}
+
+// resolveHandle finds the user for a current or recently changed handle.
+// redirected is true when the handle is an old one.
+func (s *DBStructure) resolveHandle(handle string) (user User, redirected bool, err error) {
+	key := handleKey(handle)
+	if key == "" {
+		return User{}, false, fmt.Errorf("handle %w", ErrNotFound)
+	}
+	for _, u := range s.Users {
+		if handleKey(u.Handle) == key {
+			return u, false, nil
+		}
+	}
+	if redirect, ok := s.HandleRedirects[key]; ok && redirect.ExpiresAt.After(time.Now().UTC()) {
+		if u, ok := s.Users[redirect.UserID]; ok {
+			return u, true, nil
+		}
+	}
+	return User{}, false, fmt.Errorf("handle %w", ErrNotFound)
+}
+
+// ResolveHandle looks a user up by handle, following recent handle changes
+func (db *DB) ResolveHandle(handle string) (User, bool, error) {
+	dbStruct, err := db.loadDB()
+	if err != nil {
+		return User{}, false, err
+	}
+	return dbStruct.resolveHandle(handle)
+}
+
+func (cfg *apiConfig) handlerGetUserByHandle(w http.ResponseWriter, r *http.Request) {
+	handle := chi.URLParam(r, "handle")
+
+	user, redirected, err := cfg.database.ResolveHandle(handle)
+	if err != nil {
+		respondWithDBError(w, err, "User not found")
+		return
+	}
+	if redirected {
+		// not permanent: the old handle becomes free again once the
+		// redirect expires, and caches must not keep pointing it here
+		http.Redirect(w, r, "/api/handles/"+user.Handle, http.StatusFound)
+		return
+	}
+
+	_, profile, err := cfg.database.GetUserProfile(user.ID)
+	if err != nil {
+		respondWithDBError(w, err, "User not found")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, profile)
+}
+
+func respondWithHandleConflict(w http.ResponseWriter) {
+	respondWithProblem(w, http.StatusConflict, "handle_taken", "Handle already in use", FieldErrors{
+		"handle": "is already in use",
+	})
+}
+
+// respondWithUserConflict answers a conflict from CreateUser or UpdateUser
+func respondWithUserConflict(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrHandleTaken) {
+		respondWithHandleConflict(w)
+		return
+	}
+	respondWithEmailConflict(w)
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// loginAttemptWindow is how far back failed attempts are counted
+	loginAttemptWindow = 15 * time.Minute
+	// loginMaxFailures is the number of failures in the window that triggers a lockout
+	loginMaxFailures = 5
+	// loginLockoutDuration is how long a key stays locked once the limit is hit
+	loginLockoutDuration = 15 * time.Minute
+	// loginDelayStep is the base of the progressive delay applied after failures
+	loginDelayStep = 250 * time.Millisecond
+	// loginMaxDelay caps the progressive delay
+	loginMaxDelay = 4 * time.Second
+)
+
+type LoginAttempt struct {
+	Key         string      `json:"key"`
+	Failures    []time.Time `json:"failures"`
+	LockedUntil time.Time   `json:"locked_until"`
+}
+
+// loginAttemptKeys returns the tracker keys for a login request
+func loginAttemptKeys(email, ip string) []string {
+	keys := []string{"email:" + strings.ToLower(strings.TrimSpace(email))}
+	if ip != "" {
+		keys = append(keys, "ip:"+ip)
+	}
+	return keys
+}
+
+// clientIP returns the remote address of the request without the port
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// loginDelay returns the delay to apply before answering a login
+// request for a key that already has the given number of recent failures
+func loginDelay(failures int) time.Duration {
+	if failures < 2 {
+		return 0
+	}
+	delay := loginDelayStep << (failures - 2)
+	if delay > loginMaxDelay || delay <= 0 {
+		delay = loginMaxDelay
+	}
+	return delay
+}
+
+// pruneFailures drops failures that fall outside the attempt window
+func (a *LoginAttempt) pruneFailures(now time.Time) {
+	cutoff := now.Add(-loginAttemptWindow)
+	kept := a.Failures[:0]
+	for _, t := range a.Failures {
+		if t.After(cutoff) {
+			kept = append(kept, t)
+		}
+	}
+	a.Failures = kept
+}
+
+// CheckLoginAllowed reports whether any of the keys is locked out.
+// It returns the remaining lockout time and the highest number of
+// recent failures across the keys.
+func (db *DB) CheckLoginAllowed(keys []string) (time.Duration, int, error) {
+	dbStruct, err := db.loadDB()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	now := time.Now().UTC()
+	var retryAfter time.Duration
+	failures := 0
+	for _, key := range keys {
+		attempt, ok := dbStruct.LoginAttempts[key]
+		if !ok {
+			continue
+		}
+		if remaining := attempt.LockedUntil.Sub(now); remaining > retryAfter {
+			retryAfter = remaining
+		}
+		attempt.pruneFailures(now)
+		if len(attempt.Failures) > failures {
+			failures = len(attempt.Failures)
+		}
+	}
+	return retryAfter, failures, nil
+}
+
+// RecordLoginFailure stores a failed attempt for each key and locks
+// keys that exceed the limit. It returns the longest lockout applied.
+func (db *DB) RecordLoginFailure(keys []string) (time.Duration, error) {
+	var lockedFor time.Duration
+	err := db.update(func(dbStruct *DBStructure) error {
+		now := time.Now().UTC()
+		for _, key := range keys {
+			attempt := dbStruct.LoginAttempts[key]
+			attempt.Key = key
+			attempt.pruneFailures(now)
+			attempt.Failures = append(attempt.Failures, now)
+			if len(attempt.Failures) >= loginMaxFailures {
+				attempt.LockedUntil = now.Add(loginLockoutDuration)
+				attempt.Failures = nil
+				lockedFor = loginLockoutDuration
+			}
+			dbStruct.LoginAttempts[key] = attempt
+		}
+		return nil
+	})
+	return lockedFor, err
+}
+
+// ClearLoginAttempts removes any tracked failures and lockouts for the keys
+func (db *DB) ClearLoginAttempts(keys []string) error {
+	err := db.update(func(dbStruct *DBStructure) error {
+		changed := false
+		for _, key := range keys {
+			if _, ok := dbStruct.LoginAttempts[key]; ok {
+				delete(dbStruct.LoginAttempts, key)
+				changed = true
+			}
+		}
+		if !changed {
+			return errNoChanges
+		}
+		return nil
+	})
+	if errors.Is(err, errNoChanges) {
+		return nil
+	}
+	return err
+}
+
+// ensureLoginAllowed answers 429 if any of the keys is locked out
+func (cfg *apiConfig) ensureLoginAllowed(w http.ResponseWriter, keys []string) bool {
+	retryAfter, _, err := cfg.database.CheckLoginAllowed(keys)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to check login attempts")
+		return false
+	}
+	if retryAfter > 0 {
+		respondLockedOut(w, retryAfter)
+		return false
+	}
+	return true
+}
+
+// respondWithLoginFailure counts a wrong password or code against the keys
+// and answers 401 with msg, or 429 if that locked them
+func (cfg *apiConfig) respondWithLoginFailure(w http.ResponseWriter, keys []string, msg string) {
+	lockedFor, err := cfg.database.RecordLoginFailure(keys)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to record login attempt")
+		return
+	}
+	if lockedFor > 0 {
+		respondLockedOut(w, lockedFor)
+		return
+	}
+	respondWithError(w, http.StatusUnauthorized, msg)
+}
+
+func respondLockedOut(w http.ResponseWriter, retryAfter time.Duration) {
+	seconds := int(retryAfter.Round(time.Second) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	respondWithError(w, http.StatusTooManyRequests, "Too many failed login attempts, try again later")
+}
+
+func (cfg *apiConfig) handlerAdminUnlock(w http.ResponseWriter, r *http.Request) {
+	var unlockRequest struct {
+		Email string `json:"email"`
+		IP    string `json:"ip"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&unlockRequest); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if unlockRequest.Email == "" && unlockRequest.IP == "" {
+		respondWithError(w, http.StatusBadRequest, "Email or IP is required")
+		return
+	}
+
+	var keys []string
+	if unlockRequest.Email != "" {
+		keys = append(keys, loginAttemptKeys(unlockRequest.Email, "")...)
+	}
+	if unlockRequest.IP != "" {
+		keys = append(keys, "ip:"+unlockRequest.IP)
+	}
+
+	if err := cfg.database.ClearLoginAttempts(keys); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to unlock")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"unlocked": keys,
+	})
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Mailer sends plain text emails
+type Mailer interface {
+	SendMail(to, subject, body string) error
+}
+
+// SMTPMailer delivers mail through an SMTP server
+type SMTPMailer struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+func (m *SMTPMailer) SendMail(to, subject, body string) error {
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+
+	msg := strings.Join([]string{
+		"From: " + m.From,
+		"To: " + to,
+		"Subject: " + subject,
+		"Date: " + time.Now().UTC().Format(time.RFC1123Z),
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=utf-8",
+		"",
+		body,
+	}, "\r\n")
+
+	return smtp.SendMail(m.Host+":"+m.Port, auth, m.From, []string{to}, []byte(msg))
+}
+
+// LogMailer writes mail to a file, or to the log when Path is empty.
+// It is meant for local development and testing.
+type LogMailer struct {
+	Path string
+	mu   sync.Mutex
+}
+
+func (m *LogMailer) SendMail(to, subject, body string) error {
+	entry := fmt.Sprintf("To: %s\nSubject: %s\n\n%s\n---\n", to, subject, body)
+	if m.Path == "" {
+		log.Printf("Mail:\n%s", entry)
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, err := os.OpenFile(m.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.WriteString(entry)
+	return err
+}
+
+// newMailerFromEnv picks the mailer implementation from MAILER.
+// "smtp" uses the SMTP_* variables, anything else falls back to LogMailer.
+func newMailerFromEnv() (Mailer, error) {
+	switch os.Getenv("MAILER") {
+	case "smtp":
+		m := &SMTPMailer{
+			Host:     os.Getenv("SMTP_HOST"),
+			Port:     os.Getenv("SMTP_PORT"),
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     os.Getenv("SMTP_FROM"),
+		}
+		if m.Host == "" || m.From == "" {
+			return nil, fmt.Errorf("SMTP_HOST and SMTP_FROM must be set when MAILER=smtp")
+		}
+		if m.Port == "" {
+			m.Port = "587"
+		}
+		return m, nil
+	default:
+		return &LogMailer{Path: os.Getenv("MAIL_LOG_PATH")}, nil
+	}
+}
@@ -1,24 +1,36 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/joho/godotenv"
 )
 
+// shutdownTimeout is how long open connections get to finish on shutdown
+const shutdownTimeout = 10 * time.Second
+
 func main() {
+	dbg := flag.Bool("debug", false, "Start with a fresh database")
+	createAdmin := flag.String("create-admin", "", "Create or promote an admin with this email, password from CHIRPY_ADMIN_PASSWORD, then exit")
+	flag.Parse()
 
 	// env loading
 	errEnv := godotenv.Load()
 	if errEnv != nil {
 		log.Fatalf("Error loading .env file")
 	}
-	polkaAPIKey := os.Getenv("POLKA_API_KEY")
-	if polkaAPIKey == "" {
-		log.Fatalf("POLKA_API_KEY is not set in .env file")
+	polkaVerifier, err := polkaVerifierFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid Polka webhook settings: %v", err)
 	}
 
 	jwtSecret := os.Getenv("JWT_SECRET")
@@ -26,8 +38,9 @@ func main() {
 		log.Fatalf("JWT_SECRET is not set in .env file")
 	}
 
-	_, err := os.ReadFile("database.json")
-	if err == nil {
+	// only wipe the database when asked to, so lockouts and other
+	// persisted state survive restarts
+	if *dbg {
 		os.Remove("database.json")
 	}
 	r := chi.NewRouter() // Chi router
@@ -41,14 +54,84 @@ func main() {
 		log.Fatalf("Failed to initialize database: %v", err)
 	}
 	log.Println("Database initialized.")
+	events := NewEventBus()
+	newDB.Events = events
+
+	if *createAdmin != "" {
+		policy, err := passwordPolicyFromEnv()
+		if err != nil {
+			log.Fatalf("Invalid password policy: %v", err)
+		}
+		adminUser, err := bootstrapAdmin(newDB, policy, *createAdmin, os.Getenv("CHIRPY_ADMIN_PASSWORD"))
+		if err != nil {
+			log.Fatalf("Failed to create admin: %v", err)
+		}
+		log.Printf("User %d (%s) is an admin", adminUser.ID, adminUser.Email)
+		return
+	}
+
+	mailer, err := newMailerFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to configure mailer: %v", err)
+	}
+	policy, err := passwordPolicyFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid password policy: %v", err)
+	}
+	reportHideThreshold, err := reportHideThresholdFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid report settings: %v", err)
+	}
+	chirpDeletionPolicy, err := chirpDeletionPolicyFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid account deletion settings: %v", err)
+	}
+	maxUploadBytes, err := maxUploadBytesFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid media settings: %v", err)
+	}
+	corsPolicy, err := corsPolicyFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid CORS settings: %v", err)
+	}
+	mediaDir := os.Getenv("MEDIA_DIR")
+	if mediaDir == "" {
+		mediaDir = "media"
+	}
+	blobStore, err := NewLocalBlobStore(mediaDir)
+	if err != nil {
+		log.Fatalf("Failed to initialize media storage: %v", err)
+	}
+	baseURL := os.Getenv("BASE_URL")
+	if baseURL == "" {
+		baseURL = "http://localhost:8080"
+	}
 
 	cfg := &apiConfig{
-		database:    newDB,
-		jwtSecret:   jwtSecret,
-		polkaAPIKey: polkaAPIKey,
+		database:            newDB,
+		jwtSecret:           jwtSecret,
+		mailer:              mailer,
+		baseURL:             baseURL,
+		passwordPolicy:      policy,
+		reportHideThreshold: reportHideThreshold,
+		chirpDeletionPolicy: chirpDeletionPolicy,
+		blobStore:           blobStore,
+		maxUploadBytes:      maxUploadBytes,
+		chirpStream:         NewChirpStream(),
+		wsHub:               NewWSHub(),
+		rateLimiter:         NewRateLimiter(maxRateLimitBuckets),
 	} // apiconfig
+	cfg.registerWebhookProvider(cfg.polkaProvider(polkaVerifier))
 	const port = "8080"
 
+	go runSubscriptionSweeper(newDB, subscriptionSweepInterval)
+	subscribeOutboundWebhooks(events, newDB)
+	subscribeChirpStream(events, cfg.chirpStream)
+	subscribeWSHub(events, cfg.wsHub)
+	subscribeNotifications(events, newDB)
+	subscribeMediaCleanup(events, newDB, blobStore)
+	go runWebhookDispatcher(newDB, dispatchInterval)
+
 	fileServer := http.FileServer(http.Dir(".")) // project root
 	wrappedFileServer := cfg.middlewareMetricsInc(http.StripPrefix("/app", fileServer))
 	// Chi handles routing now
@@ -61,30 +144,102 @@ func main() {
 		w.Write([]byte("OK"))
 	})
 
+	admin.Use(cfg.middlewareRequireRole(RoleAdmin))
 	admin.Get("/metrics", cfg.metricsHandler) // only GET
-	apiRouter.HandleFunc("/reset", cfg.resetHandler)
+	admin.Post("/unlock", cfg.handlerAdminUnlock)
+	admin.Put("/users/{userID}/role", cfg.handlerAdminSetRole)
+	admin.Get("/moderation/log", cfg.handlerGetModerationLog)
+	admin.Get("/reports", cfg.handlerGetReports)
+	admin.Post("/reports/{reportID}/dismiss", cfg.handlerDismissReport)
+	admin.Post("/reports/{reportID}/action", cfg.handlerActOnReport)
+	admin.Get("/webhook-events", cfg.handlerGetWebhookEvents)
+	admin.Get("/webhook-events/{provider}/{eventID}", cfg.handlerGetWebhookEvent)
+	admin.Post("/webhook-events/{provider}/{eventID}/replay", cfg.handlerReplayWebhookEvent)
+	apiRouter.With(cfg.middlewareRequireRole(RoleAdmin)).HandleFunc("/reset", cfg.resetHandler)
 	apiRouter.Post("/validate_chirp", cfg.handlerChirpsValidate)
-	apiRouter.Post("/chirps", cfg.handlerCreateChirp)
+	apiRouter.With(cfg.middlewareRateLimit(chirpRateLimit)).Post("/chirps", cfg.handlerCreateChirp)
 	apiRouter.Get("/chirps", cfg.handlerGetChirps)
+	apiRouter.Get("/chirps/stream", cfg.handlerChirpStream)
+	apiRouter.Get("/ws", cfg.handlerWebSocket)
 	apiRouter.Get("/chirps/{chirpID}", cfg.handlerGetChirpsByID)
-	apiRouter.Post("/users", cfg.handlerCreateUser)
-	apiRouter.Post("/login", cfg.handlerLogin)
+	apiRouter.Put("/chirps/{chirpID}", cfg.handlerEditChirp)
+	apiRouter.With(cfg.middlewareRateLimit(signupRateLimit)).Post("/users", cfg.handlerCreateUser)
+	apiRouter.With(cfg.middlewareRateLimit(loginRateLimit)).Post("/login", cfg.handlerLogin)
+	apiRouter.With(cfg.middlewareRateLimit(loginRateLimit)).Post("/login/mfa", cfg.handlerLoginMFA)
+	apiRouter.Post("/2fa/enroll", cfg.handlerTOTPEnroll)
+	apiRouter.With(cfg.middlewareRateLimit(twoFactorRateLimit)).Post("/2fa/verify", cfg.handlerTOTPVerify)
+	apiRouter.With(cfg.middlewareRateLimit(twoFactorRateLimit)).Post("/2fa/disable", cfg.handlerTOTPDisable)
 	apiRouter.Put("/users", cfg.handleUpdateUsers)
+	apiRouter.Patch("/users", cfg.handleUpdateUsers)
+	apiRouter.Delete("/users", cfg.handlerDeleteUser)
+	apiRouter.Get("/users/me", cfg.handlerGetMe)
+	apiRouter.Get("/users/{userID}", cfg.handlerGetUser)
+	apiRouter.Get("/users/me/export", cfg.handlerExportUser)
+	apiRouter.Get("/handles/{handle}", cfg.handlerGetUserByHandle)
+	apiRouter.With(cfg.middlewareRateLimit(emailRateLimit)).Post("/users/verify/request", cfg.handlerRequestVerification)
+	apiRouter.Post("/users/verify", cfg.handlerVerifyEmail)
+	apiRouter.With(cfg.middlewareRateLimit(passwordResetRateLimit)).Post("/password/forgot", cfg.handlerForgotPassword)
+	apiRouter.Post("/password/reset", cfg.handlerResetPassword)
 	apiRouter.Post("/refresh", cfg.handlerRefreshToken)
 	apiRouter.Post("/revoke", cfg.handlerRevokeToken)
 	apiRouter.Delete("/chirps/{chirpID}", cfg.handlerDeleteChirp)
+	apiRouter.Post("/chirps/{chirpID}/reports", cfg.handlerCreateReport)
+	apiRouter.Post("/chirps/{chirpID}/media", cfg.handlerUploadChirpMedia)
+	apiRouter.Put("/users/avatar", cfg.handlerUploadAvatar)
+	apiRouter.Get("/media/{key}", cfg.handlerGetMedia)
 	apiRouter.Post("/polka/webhooks", cfg.handlePolkaWebhooks)
+	apiRouter.Post("/webhooks/{provider}", cfg.handlerWebhooks)
+	apiRouter.Post("/webhook-endpoints", cfg.handlerCreateWebhookEndpoint)
+	apiRouter.Get("/webhook-endpoints", cfg.handlerGetWebhookEndpoints)
+	apiRouter.Delete("/webhook-endpoints/{endpointID}", cfg.handlerDeleteWebhookEndpoint)
+	apiRouter.Post("/webhook-endpoints/{endpointID}/enable", cfg.handlerEnableWebhookEndpoint)
+	apiRouter.Get("/webhook-endpoints/{endpointID}/deliveries", cfg.handlerGetWebhookDeliveries)
+	apiRouter.Get("/notifications", cfg.handlerGetNotifications)
+	apiRouter.Get("/notifications/unread_count", cfg.handlerGetUnreadCount)
+	apiRouter.Post("/notifications/read", cfg.handlerMarkNotificationsRead)
+	apiRouter.Post("/notifications/{notificationID}/read", cfg.handlerMarkNotificationRead)
+
+	apiRouter.Group(func(mod chi.Router) {
+		mod.Use(cfg.middlewareRequireRole(RoleModerator, RoleAdmin))
+		mod.Delete("/moderation/chirps/{chirpID}", cfg.handlerModerateDeleteChirp)
+		mod.Post("/moderation/users/{userID}/suspend", cfg.handlerSuspendUser)
+		mod.Post("/moderation/users/{userID}/unsuspend", cfg.handlerUnsuspendUser)
+	})
 
 	// mount before server config
 	r.Mount("/api", apiRouter)
 	r.Mount("/admin", admin)
 
-	corsHandler := middlewareCors(r)
+	corsHandler := middlewareCors(corsPolicy, r, middlewareRequestID(r))
 	server := &http.Server{
 		Handler: corsHandler,
 		Addr:    "localhost:" + port,
 	}
+	// Shutdown waits for requests to finish but never cancels them, so
+	// end the open chirp streams
+	server.RegisterOnShutdown(cfg.chirpStream.Close)
+
+	go func() {
+		log.Printf("Serving on port: %s\n", port)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
 
-	log.Printf("Serving on port: %s\n", port)
-	log.Fatal(server.ListenAndServe())
+	// shut down cleanly on Ctrl-C or SIGTERM so WebSocket clients get a
+	// close frame and queued events are handled
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
+	log.Println("Shutting down...")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := cfg.wsHub.Shutdown(shutdownCtx); err != nil {
+		log.Printf("WebSocket shutdown: %v", err)
+	}
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Server shutdown: %v", err)
+	}
+	events.Close()
 }
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	defaultMaxUploadBytes = 5 << 20
+	// maxImagePixels guards against small files that decode to huge
+	// images. Decoding takes up to 8 bytes a pixel, so this is ~128MB.
+	maxImagePixels     = 16_000_000
+	chirpThumbnailSize = 320
+	avatarSize         = 256
+	// maxChirpMedia is the most images any plan allows on a chirp
+	maxChirpMedia     = 4
+	mediaCacheControl = "public, max-age=31536000, immutable"
+)
+
+// allowedImageTypes are the sniffed content types we accept
+var allowedImageTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+}
+
+// ErrUnsupportedMedia -
+var ErrUnsupportedMedia = errors.New("unsupported media type")
+
+// Attachment is an image attached to a chirp
+type Attachment struct {
+	Key          string `json:"key"`
+	URL          string `json:"url"`
+	ThumbnailURL string `json:"thumbnail_url"`
+	ContentType  string `json:"content_type"`
+	Width        int    `json:"width"`
+	Height       int    `json:"height"`
+	Size         int    `json:"size"`
+}
+
+func mediaURL(key string) string {
+	return "/api/media/" + key
+}
+
+// mediaKey returns the blob key behind a media URL, or "" for URLs that
+// don't point at our media
+func mediaKey(url string) string {
+	_, key, ok := strings.Cut(url, "/api/media/")
+	if !ok || !validBlobKey.MatchString(key) {
+		return ""
+	}
+	return key
+}
+
+// blobKeys are the blobs an attachment uses, the image and its thumbnail
+func (a Attachment) blobKeys() []string {
+	keys := []string{a.Key}
+	if thumbKey := mediaKey(a.ThumbnailURL); thumbKey != "" {
+		keys = append(keys, thumbKey)
+	}
+	return keys
+}
+
+// unusedBlobs filters keys down to those no chirp or avatar refers to.
+// Blobs are shared between identical uploads, so they can only go once
+// the last reference does.
+func (s *DBStructure) unusedBlobs(keys []string) []string {
+	inUse := make(map[string]bool)
+	for _, chirp := range s.Chirps {
+		for _, attachment := range chirp.Media {
+			for _, key := range attachment.blobKeys() {
+				inUse[key] = true
+			}
+		}
+	}
+	for _, user := range s.Users {
+		if key := mediaKey(user.AvatarURL); key != "" {
+			inUse[key] = true
+		}
+	}
+
+	var unused []string
+	for _, key := range keys {
+		if key != "" && !inUse[key] {
+			inUse[key] = true // skip duplicates
+			unused = append(unused, key)
+		}
+	}
+	return unused
+}
+
+// UnusedBlobs filters keys down to those nothing refers to anymore
+func (db *DB) UnusedBlobs(keys []string) ([]string, error) {
+	dbStruct, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+	return dbStruct.unusedBlobs(keys), nil
+}
+
+// deleteBlobs removes blobs that are no longer referenced. The data
+// change has already happened, so failures are only logged.
+func deleteBlobs(store BlobStore, keys []string) {
+	for _, key := range keys {
+		if err := store.Delete(key); err != nil {
+			log.Printf("Error deleting blob %s: %v", key, err)
+		}
+	}
+}
+
+// deleteUnusedBlobs removes whichever of keys nothing refers to anymore.
+// It must not be called while holding BlobMux.
+func deleteUnusedBlobs(db *DB, store BlobStore, keys []string) {
+	db.BlobMux.Lock()
+	defer db.BlobMux.Unlock()
+	unused, err := db.UnusedBlobs(keys)
+	if err != nil {
+		log.Printf("Error checking blobs for deletion: %v", err)
+		return
+	}
+	deleteBlobs(store, unused)
+}
+
+// subscribeMediaCleanup removes the images of deleted chirps, however
+// they were deleted
+func subscribeMediaCleanup(bus *EventBus, db *DB, store BlobStore) {
+	bus.SubscribeAsync(EventChirpDeleted, func(event Event) {
+		deleted, ok := event.(ChirpDeleted)
+		if !ok {
+			return
+		}
+		var keys []string
+		for _, attachment := range deleted.Chirp.Media {
+			keys = append(keys, attachment.blobKeys()...)
+		}
+		if len(keys) > 0 {
+			deleteUnusedBlobs(db, store, keys)
+		}
+	})
+}
+
+// maxUploadBytesFromEnv reads MEDIA_MAX_BYTES
+func maxUploadBytesFromEnv() (int64, error) {
+	v := os.Getenv("MEDIA_MAX_BYTES")
+	if v == "" {
+		return defaultMaxUploadBytes, nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("MEDIA_MAX_BYTES must be a positive number")
+	}
+	return n, nil
+}
+
+// storeImage checks an uploaded image, stores it and a thumbnail that fits
+// in thumbSize x thumbSize, and describes the result. Callers hold
+// BlobMux for reading until the attachment is referenced.
+func storeImage(store BlobStore, data []byte, thumbSize int) (Attachment, error) {
+	contentType := http.DetectContentType(data)
+	if !allowedImageTypes[contentType] {
+		return Attachment{}, fmt.Errorf("%s: %w", contentType, ErrUnsupportedMedia)
+	}
+
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return Attachment{}, fmt.Errorf("decoding image: %w", ErrUnsupportedMedia)
+	}
+	if config.Width*config.Height > maxImagePixels {
+		return Attachment{}, fmt.Errorf("image is too large: %w", ErrInvalidInput)
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return Attachment{}, fmt.Errorf("decoding image: %w", ErrUnsupportedMedia)
+	}
+
+	var thumb bytes.Buffer
+	resized := resizeToFit(img, thumbSize)
+	if format == "jpeg" {
+		err = jpeg.Encode(&thumb, resized, &jpeg.Options{Quality: 80})
+	} else {
+		// png keeps transparency from png and gif sources
+		err = png.Encode(&thumb, resized)
+	}
+	if err != nil {
+		return Attachment{}, err
+	}
+
+	key, err := store.Put(data)
+	if err != nil {
+		return Attachment{}, err
+	}
+	thumbKey, err := store.Put(thumb.Bytes())
+	if err != nil {
+		return Attachment{}, err
+	}
+
+	return Attachment{
+		Key:          key,
+		URL:          mediaURL(key),
+		ThumbnailURL: mediaURL(thumbKey),
+		ContentType:  contentType,
+		Width:        config.Width,
+		Height:       config.Height,
+		Size:         len(data),
+	}, nil
+}
+
+// resizeToFit scales src down to fit in maxDim x maxDim, averaging the
+// source pixels that fall into each destination pixel
+func resizeToFit(src image.Image, maxDim int) image.Image {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= maxDim && h <= maxDim {
+		return src
+	}
+
+	dw, dh := maxDim, maxDim
+	if w > h {
+		dh = max(1, h*maxDim/w)
+	} else {
+		dw = max(1, w*maxDim/h)
+	}
+
+	dst := image.NewRGBA64(image.Rect(0, 0, dw, dh))
+	for dy := 0; dy < dh; dy++ {
+		y0 := b.Min.Y + dy*h/dh
+		y1 := max(y0+1, b.Min.Y+(dy+1)*h/dh)
+		for dx := 0; dx < dw; dx++ {
+			x0 := b.Min.X + dx*w/dw
+			x1 := max(x0+1, b.Min.X+(dx+1)*w/dw)
+
+			var r, g, bl, a, n uint64
+			for y := y0; y < y1; y++ {
+				for x := x0; x < x1; x++ {
+					pr, pg, pb, pa := src.At(x, y).RGBA()
+					r += uint64(pr)
+					g += uint64(pg)
+					bl += uint64(pb)
+					a += uint64(pa)
+					n++
+				}
+			}
+			dst.SetRGBA64(dx, dy, color.RGBA64{
+				R: uint16(r / n),
+				G: uint16(g / n),
+				B: uint16(bl / n),
+				A: uint16(a / n),
+			})
+		}
+	}
+	return dst
+}
+
+// readUpload reads the "file" part of a multipart request, enforcing limit
+func readUpload(w http.ResponseWriter, r *http.Request, limit int64) ([]byte, error) {
+	// leave room for the multipart framing around the file
+	r.Body = http.MaxBytesReader(w, r.Body, limit+64<<10)
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			return nil, errFileTooLarge
+		}
+		return nil, fmt.Errorf("reading file: %w", ErrInvalidInput)
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, errFileTooLarge
+	}
+	if len(data) == 0 {
+		return nil, fmt.Errorf("empty file: %w", ErrInvalidInput)
+	}
+	return data, nil
+}
+
+var errFileTooLarge = errors.New("file too large")
+
+// respondWithUploadError maps errors from readUpload and storeImage
+func respondWithUploadError(w http.ResponseWriter, err error, limit int64) {
+	switch {
+	case errors.Is(err, errFileTooLarge):
+		respondWithError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("File is larger than %d bytes", limit))
+	case errors.Is(err, ErrUnsupportedMedia):
+		respondWithError(w, http.StatusUnsupportedMediaType, "Only PNG, JPEG and GIF images are supported")
+	case errors.Is(err, ErrInvalidInput):
+		respondWithError(w, http.StatusBadRequest, "Send the image as multipart form field \"file\"")
+	default:
+		respondWithError(w, http.StatusInternalServerError, "Failed to store image")
+	}
+}
+
+// AddChirpMedia attaches an image to a chirp owned by userID
+func (db *DB) AddChirpMedia(chirpID, userID int, attachment Attachment, limit int) (Chirp, error) {
+	var chirp Chirp
+	err := db.update(func(dbStruct *DBStructure) error {
+		var ok bool
+		chirp, ok = dbStruct.Chirps[chirpID]
+		if !ok {
+			return fmt.Errorf("chirp %w", ErrNotFound)
+		}
+		if chirp.AuthorID != userID {
+			return fmt.Errorf("not the author: %w", ErrForbidden)
+		}
+		if len(chirp.Media) >= limit {
+			return fmt.Errorf("chirps can have at most %d images: %w", limit, ErrConflict)
+		}
+		chirp.Media = append(chirp.Media, attachment)
+		dbStruct.Chirps[chirpID] = chirp
+		return nil
+	})
+	return chirp, err
+}
+
+func (cfg *apiConfig) handlerUploadChirpMedia(w http.ResponseWriter, r *http.Request) {
+	chirpID, err := strconv.Atoi(chi.URLParam(r, "chirpID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid chirp ID")
+		return
+	}
+	userID, err := cfg.getAuthenticatedUserID(r)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	_, limits, err := cfg.entitlementsFor(userID)
+	if err != nil {
+		respondWithDBError(w, err, "User not found")
+		return
+	}
+	if limits.MediaPerChirp == 0 {
+		respondWithPlanRequired(w, "Attaching images")
+		return
+	}
+
+	chirp, err := cfg.database.GetChirpByID(chirpID)
+	if err != nil {
+		respondWithDBError(w, err, "Chirp not found")
+		return
+	}
+	if chirp.AuthorID != userID {
+		respondWithError(w, http.StatusForbidden, "User is not the author of the chirp")
+		return
+	}
+	if len(chirp.Media) >= limits.MediaPerChirp {
+		respondWithError(w, http.StatusConflict, fmt.Sprintf("Chirps can have at most %d images", limits.MediaPerChirp))
+		return
+	}
+
+	data, err := readUpload(w, r, cfg.maxUploadBytes)
+	if err != nil {
+		respondWithUploadError(w, err, cfg.maxUploadBytes)
+		return
+	}
+	cfg.database.BlobMux.RLock()
+	attachment, err := storeImage(cfg.blobStore, data, chirpThumbnailSize)
+	if err != nil {
+		cfg.database.BlobMux.RUnlock()
+		respondWithUploadError(w, err, cfg.maxUploadBytes)
+		return
+	}
+	chirp, err = cfg.database.AddChirpMedia(chirpID, userID, attachment, limits.MediaPerChirp)
+	cfg.database.BlobMux.RUnlock()
+	if err != nil {
+		// e.g. the chirp was deleted or filled up meanwhile
+		deleteUnusedBlobs(cfg.database, cfg.blobStore, attachment.blobKeys())
+		respondWithDBError(w, err, "Failed to attach image")
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, chirp)
+}
+
+func (cfg *apiConfig) handlerUploadAvatar(w http.ResponseWriter, r *http.Request) {
+	userID, err := cfg.getAuthenticatedUserID(r)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	data, err := readUpload(w, r, cfg.maxUploadBytes)
+	if err != nil {
+		respondWithUploadError(w, err, cfg.maxUploadBytes)
+		return
+	}
+	previous, err := cfg.database.GetUserByID(userID)
+	if err != nil {
+		respondWithDBError(w, err, "User not found")
+		return
+	}
+
+	// the avatar is served from the resized copy
+	cfg.database.BlobMux.RLock()
+	attachment, err := storeImage(cfg.blobStore, data, avatarSize)
+	if err != nil {
+		cfg.database.BlobMux.RUnlock()
+		respondWithUploadError(w, err, cfg.maxUploadBytes)
+		return
+	}
+	avatarURL := cfg.baseURL + attachment.ThumbnailURL
+	_, err = cfg.database.UpdateUser(userID, UserUpdate{AvatarURL: &avatarURL})
+	cfg.database.BlobMux.RUnlock()
+	if err != nil {
+		deleteUnusedBlobs(cfg.database, cfg.blobStore, attachment.blobKeys())
+		respondWithDBError(w, err, "Failed to update avatar")
+		return
+	}
+	// only the resized copy is kept, and the old avatar is replaced
+	deleteUnusedBlobs(cfg.database, cfg.blobStore, []string{attachment.Key, mediaKey(previous.AvatarURL)})
+
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"avatar_url": avatarURL,
+	})
+}
+
+func (cfg *apiConfig) handlerGetMedia(w http.ResponseWriter, r *http.Request) {
+	key := chi.URLParam(r, "key")
+	blob, err := cfg.blobStore.Open(key)
+	if err != nil {
+		respondWithDBError(w, err, "Media not found")
+		return
+	}
+	defer blob.Close()
+
+	// keys are content hashes, so the content behind a URL never changes
+	w.Header().Set("Cache-Control", mediaCacheControl)
+	w.Header().Set("ETag", `"`+key+`"`)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(w, r, "", time.Time{}, blob)
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	ActionDeleteChirp = "chirp.delete"
+	ActionSuspendUser = "user.suspend"
+	ActionRestoreUser = "user.unsuspend"
+
+	maxModerationReasonLength = 500
+	defaultModerationLogLimit = 50
+)
+
+// ErrUserSuspended -
+var ErrUserSuspended = errors.New("user is suspended")
+
+// ModerationAction is an entry in the moderation audit log
+type ModerationAction struct {
+	ID         int       `json:"id"`
+	ActorID    int       `json:"actor_id"`
+	Action     string    `json:"action"`
+	TargetType string    `json:"target_type"`
+	TargetID   int       `json:"target_id"`
+	Reason     string    `json:"reason"`
+	CreatedAt  time.Time `json:"created_at"`
+	// Snapshot keeps what was removed, e.g. the body of a deleted chirp
+	Snapshot string `json:"snapshot,omitempty"`
+}
+
+// redactedSnapshot replaces the chirp bodies of deleted users
+const redactedSnapshot = "[removed with the account]"
+
+// chirpSnapshotPrefix starts the snapshot of a deleted chirp
+func chirpSnapshotPrefix(authorID int) string {
+	return fmt.Sprintf("author %d: ", authorID)
+}
+
+// appendModerationAction adds an entry to the audit log
+func (s *DBStructure) appendModerationAction(action ModerationAction) ModerationAction {
+	action.ID = len(s.ModerationLog) + 1
+	action.CreatedAt = time.Now().UTC()
+	s.ModerationLog = append(s.ModerationLog, action)
+	return action
+}
+
+// moderateDeleteChirp removes any chirp and records why
+func (s *DBStructure) moderateDeleteChirp(chirpID, actorID int, reason string) (Chirp, ModerationAction, error) {
+	chirp, ok := s.Chirps[chirpID]
+	if !ok {
+		return Chirp{}, ModerationAction{}, fmt.Errorf("chirp %w", ErrNotFound)
+	}
+	delete(s.Chirps, chirpID)
+	logged := s.appendModerationAction(ModerationAction{
+		ActorID:    actorID,
+		Action:     ActionDeleteChirp,
+		TargetType: "chirp",
+		TargetID:   chirpID,
+		Reason:     reason,
+		Snapshot:   chirpSnapshotPrefix(chirp.AuthorID) + chirp.Body,
+	})
+	return chirp, logged, nil
+}
+
+// ModerateDeleteChirp removes any chirp and records why
+func (db *DB) ModerateDeleteChirp(chirpID, actorID int, reason string) (ModerationAction, error) {
+	var logged ModerationAction
+	var chirp Chirp
+	err := db.update(func(dbStruct *DBStructure) error {
+		var err error
+		chirp, logged, err = dbStruct.moderateDeleteChirp(chirpID, actorID, reason)
+		return err
+	})
+	if err == nil {
+		db.publish(ChirpDeleted{Chirp: chirp, ActorID: actorID})
+	}
+	return logged, err
+}
+
+// setUserSuspended suspends or restores a user and records why.
+// Moderators can only act on plain users, admins on anyone but admins.
+func (s *DBStructure) setUserSuspended(userID, actorID int, actorRole Role, suspended bool, reason string) (ModerationAction, error) {
+	user, ok := s.Users[userID]
+	if !ok {
+		return ModerationAction{}, fmt.Errorf("user %w", ErrNotFound)
+	}
+	if userID == actorID {
+		return ModerationAction{}, fmt.Errorf("can't suspend yourself: %w", ErrForbidden)
+	}
+	target := user.EffectiveRole()
+	if target == RoleAdmin || (actorRole != RoleAdmin && target != RoleUser) {
+		return ModerationAction{}, fmt.Errorf("can't suspend a %s: %w", target, ErrForbidden)
+	}
+	if user.Suspended == suspended {
+		return ModerationAction{}, fmt.Errorf("suspension unchanged: %w", ErrConflict)
+	}
+
+	user.Suspended = suspended
+	action := ActionRestoreUser
+	if suspended {
+		action = ActionSuspendUser
+		user.SuspendedReason = reason
+	} else {
+		user.SuspendedReason = ""
+	}
+	s.Users[userID] = user
+
+	return s.appendModerationAction(ModerationAction{
+		ActorID:    actorID,
+		Action:     action,
+		TargetType: "user",
+		TargetID:   userID,
+		Reason:     reason,
+	}), nil
+}
+
+// SetUserSuspended suspends or restores a user and records why
+func (db *DB) SetUserSuspended(userID, actorID int, actorRole Role, suspended bool, reason string) (ModerationAction, error) {
+	var logged ModerationAction
+	err := db.update(func(dbStruct *DBStructure) error {
+		var err error
+		logged, err = dbStruct.setUserSuspended(userID, actorID, actorRole, suspended, reason)
+		return err
+	})
+	return logged, err
+}
+
+// ModerationLogFilter narrows GetModerationLog; zero values match everything
+type ModerationLogFilter struct {
+	ActorID    int
+	Action     string
+	TargetType string
+	TargetID   int
+	Limit      int
+}
+
+// GetModerationLog returns matching entries, newest first
+func (db *DB) GetModerationLog(filter ModerationLogFilter) ([]ModerationAction, error) {
+	dbStruct, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+
+	actions := []ModerationAction{}
+	for _, a := range dbStruct.ModerationLog {
+		if filter.ActorID != 0 && a.ActorID != filter.ActorID {
+			continue
+		}
+		if filter.Action != "" && a.Action != filter.Action {
+			continue
+		}
+		if filter.TargetType != "" && a.TargetType != filter.TargetType {
+			continue
+		}
+		if filter.TargetID != 0 && a.TargetID != filter.TargetID {
+			continue
+		}
+		actions = append(actions, a)
+	}
+	sort.Slice(actions, func(i, j int) bool { return actions[i].ID > actions[j].ID })
+	if filter.Limit > 0 && len(actions) > filter.Limit {
+		actions = actions[:filter.Limit]
+	}
+	return actions, nil
+}
+
+// decodeModerationReason reads the required reason from a request body
+func decodeModerationReason(r *http.Request) (string, FieldErrors, error) {
+	var reasonRequest struct {
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reasonRequest); err != nil {
+		return "", nil, err
+	}
+	reason := strings.TrimSpace(reasonRequest.Reason)
+	if reason == "" {
+		return "", FieldErrors{"reason": "is required"}, nil
+	}
+	if len(reason) > maxModerationReasonLength {
+		return "", FieldErrors{"reason": fmt.Sprintf("must be at most %d characters", maxModerationReasonLength)}, nil
+	}
+	return reason, nil, nil
+}
+
+func (cfg *apiConfig) handlerModerateDeleteChirp(w http.ResponseWriter, r *http.Request) {
+	chirpID, err := strconv.Atoi(chi.URLParam(r, "chirpID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid chirp ID")
+		return
+	}
+	actorID, _ := contextUserID(r)
+
+	reason, fieldErrors, err := decodeModerationReason(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if fieldErrors != nil {
+		respondWithValidationErrors(w, fieldErrors)
+		return
+	}
+
+	action, err := cfg.database.ModerateDeleteChirp(chirpID, actorID, reason)
+	if err != nil {
+		respondWithDBError(w, err, "Failed to delete chirp")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, action)
+}
+
+func (cfg *apiConfig) handlerSuspendUser(w http.ResponseWriter, r *http.Request) {
+	cfg.setUserSuspended(w, r, true)
+}
+
+func (cfg *apiConfig) handlerUnsuspendUser(w http.ResponseWriter, r *http.Request) {
+	cfg.setUserSuspended(w, r, false)
+}
+
+func (cfg *apiConfig) setUserSuspended(w http.ResponseWriter, r *http.Request, suspended bool) {
+	userID, err := strconv.Atoi(chi.URLParam(r, "userID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+	actorID, _ := contextUserID(r)
+	actorRole, _ := r.Context().Value(roleKey).(Role)
+
+	reason, fieldErrors, err := decodeModerationReason(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if fieldErrors != nil {
+		respondWithValidationErrors(w, fieldErrors)
+		return
+	}
+
+	action, err := cfg.database.SetUserSuspended(userID, actorID, actorRole, suspended, reason)
+	if err != nil {
+		respondWithDBError(w, err, "Failed to update suspension")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, action)
+}
+
+func (cfg *apiConfig) handlerGetModerationLog(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := ModerationLogFilter{
+		Action:     query.Get("action"),
+		TargetType: query.Get("target_type"),
+		Limit:      defaultModerationLogLimit,
+	}
+	for param, dest := range map[string]*int{
+		"actor_id":  &filter.ActorID,
+		"target_id": &filter.TargetID,
+		"limit":     &filter.Limit,
+	} {
+		if v := query.Get(param); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				respondWithError(w, http.StatusBadRequest, "Invalid "+param)
+				return
+			}
+			*dest = n
+		}
+	}
+
+	actions, err := cfg.database.GetModerationLog(filter)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not retrieve moderation log")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, actions)
+}
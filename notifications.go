@@ -0,0 +1,391 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Notification types
+const (
+	NotificationMention      = "mention"
+	NotificationChirpRemoved = "chirp_removed"
+	NotificationUpgraded     = "plan_upgraded"
+	NotificationDowngraded   = "plan_downgraded"
+)
+
+const (
+	// maxNotificationsPerUser caps each inbox, the oldest go first
+	maxNotificationsPerUser = 200
+	// readNotificationRetention is how long read notifications are kept
+	readNotificationRetention = 90 * 24 * time.Hour
+	// notificationGroupRefs is how many actors and chirps a grouped
+	// notification remembers
+	notificationGroupRefs    = 10
+	defaultNotificationLimit = 50
+)
+
+// groupedNotifications are the types that collect into one unread
+// notification instead of stacking up, e.g. "3 people mentioned you"
+var groupedNotifications = map[string]bool{
+	NotificationMention:      true,
+	NotificationChirpRemoved: true,
+}
+
+// Notification is an entry in a user's inbox. Grouped notifications
+// count how many events they stand for and list the latest actors and
+// chirps first.
+type Notification struct {
+	ID        int        `json:"id"`
+	UserID    int        `json:"user_id"`
+	Type      string     `json:"type"`
+	Count     int        `json:"count"`
+	ActorIDs  []int      `json:"actor_ids,omitempty"`
+	ChirpIDs  []int      `json:"chirp_ids,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	ReadAt    *time.Time `json:"read_at,omitempty"`
+}
+
+// Unread -
+func (n Notification) Unread() bool {
+	return n.ReadAt == nil
+}
+
+// prependRef puts id first in refs, without duplicates, keeping at most
+// notificationGroupRefs
+func prependRef(refs []int, id int) []int {
+	if id == 0 {
+		return refs
+	}
+	out := []int{id}
+	for _, ref := range refs {
+		if ref != id && len(out) < notificationGroupRefs {
+			out = append(out, ref)
+		}
+	}
+	return out
+}
+
+// countUnread counts a user's unread notifications
+func (s *DBStructure) countUnread(userID int) int {
+	unread := 0
+	for _, n := range s.Notifications {
+		if n.UserID == userID && n.Unread() {
+			unread++
+		}
+	}
+	return unread
+}
+
+// pruneNotifications drops a user's read notifications past their
+// retention, then the oldest ones over the cap
+func (s *DBStructure) pruneNotifications(userID int, now time.Time) {
+	var inbox []Notification
+	for id, n := range s.Notifications {
+		if n.UserID != userID {
+			continue
+		}
+		if !n.Unread() && n.ReadAt.Before(now.Add(-readNotificationRetention)) {
+			delete(s.Notifications, id)
+			continue
+		}
+		inbox = append(inbox, n)
+	}
+	if len(inbox) <= maxNotificationsPerUser {
+		return
+	}
+	sort.Slice(inbox, func(i, j int) bool { return inbox[i].UpdatedAt.After(inbox[j].UpdatedAt) })
+	for _, n := range inbox[maxNotificationsPerUser:] {
+		delete(s.Notifications, n.ID)
+	}
+}
+
+// AddNotification notifies a user. actorID and chirpID may be 0. Grouped
+// types are merged into the user's unread notification of the same type
+// if there is one.
+func (db *DB) AddNotification(userID int, kind string, actorID, chirpID int) (Notification, error) {
+	var notification Notification
+	var unread int
+	err := db.update(func(dbStruct *DBStructure) error {
+		if _, ok := dbStruct.Users[userID]; !ok {
+			return fmt.Errorf("user %w", ErrNotFound)
+		}
+		now := time.Now().UTC()
+
+		found := false
+		if groupedNotifications[kind] {
+			for _, n := range dbStruct.Notifications {
+				if n.UserID == userID && n.Type == kind && n.Unread() {
+					notification, found = n, true
+					break
+				}
+			}
+		}
+		if !found {
+			dbStruct.LastNotificationID++
+			notification = Notification{
+				ID:        dbStruct.LastNotificationID,
+				UserID:    userID,
+				Type:      kind,
+				CreatedAt: now,
+			}
+		}
+		notification.Count++
+		notification.ActorIDs = prependRef(notification.ActorIDs, actorID)
+		notification.ChirpIDs = prependRef(notification.ChirpIDs, chirpID)
+		notification.UpdatedAt = now
+		dbStruct.Notifications[notification.ID] = notification
+
+		dbStruct.pruneNotifications(userID, now)
+		unread = dbStruct.countUnread(userID)
+		return nil
+	})
+	if err != nil {
+		return Notification{}, err
+	}
+
+	db.publish(NotificationAdded{Notification: notification, UnreadCount: unread})
+	return notification, nil
+}
+
+// GetNotifications returns a user's notifications, most recently updated
+// first, and how many are unread. limit 0 means no limit.
+func (db *DB) GetNotifications(userID int, unreadOnly bool, limit int) ([]Notification, int, error) {
+	dbStruct, err := db.loadDB()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	notifications := []Notification{}
+	for _, n := range dbStruct.Notifications {
+		if n.UserID == userID && (!unreadOnly || n.Unread()) {
+			notifications = append(notifications, n)
+		}
+	}
+	sort.Slice(notifications, func(i, j int) bool {
+		if !notifications[i].UpdatedAt.Equal(notifications[j].UpdatedAt) {
+			return notifications[i].UpdatedAt.After(notifications[j].UpdatedAt)
+		}
+		return notifications[i].ID > notifications[j].ID
+	})
+	if limit > 0 && len(notifications) > limit {
+		notifications = notifications[:limit]
+	}
+	return notifications, dbStruct.countUnread(userID), nil
+}
+
+// UnreadNotificationCount -
+func (db *DB) UnreadNotificationCount(userID int) (int, error) {
+	dbStruct, err := db.loadDB()
+	if err != nil {
+		return 0, err
+	}
+	return dbStruct.countUnread(userID), nil
+}
+
+// MarkNotificationsRead marks the given notifications read, or all of
+// the user's when ids is empty, and returns how many are still unread.
+// Other users' notifications count as not found.
+func (db *DB) MarkNotificationsRead(userID int, ids []int) (int, error) {
+	var unread int
+	err := db.update(func(dbStruct *DBStructure) error {
+		for _, id := range ids {
+			if n, ok := dbStruct.Notifications[id]; !ok || n.UserID != userID {
+				return fmt.Errorf("notification %w", ErrNotFound)
+			}
+		}
+
+		now := time.Now().UTC()
+		changed := false
+		for id, n := range dbStruct.Notifications {
+			if n.UserID != userID || !n.Unread() {
+				continue
+			}
+			if len(ids) > 0 && !containsInt(ids, id) {
+				continue
+			}
+			n.ReadAt = &now
+			dbStruct.Notifications[id] = n
+			changed = true
+		}
+		unread = dbStruct.countUnread(userID)
+		if !changed {
+			return errNoChanges
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errNoChanges) {
+		return 0, err
+	}
+	return unread, nil
+}
+
+func containsInt(values []int, v int) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+// chirpMentions returns the lowercased handles mentioned in a chirp body,
+// once each
+func chirpMentions(body string) []string {
+	return uniqueMatches(chirpMentionPattern, body)
+}
+
+// MentionedUsers resolves the handles mentioned in a chirp, leaving out
+// the author and handles nobody has
+func (db *DB) MentionedUsers(chirp Chirp) ([]User, error) {
+	handles := chirpMentions(chirp.Body)
+	if len(handles) == 0 {
+		return nil, nil
+	}
+	dbStruct, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+	var users []User
+	for _, handle := range handles {
+		user, _, err := dbStruct.resolveHandle(handle)
+		if err != nil || user.ID == chirp.AuthorID {
+			continue
+		}
+		users = append(users, user)
+	}
+	return users, nil
+}
+
+// subscribeNotifications turns domain events into notifications. It runs
+// async since it writes to the DB itself.
+func subscribeNotifications(bus *EventBus, db *DB) {
+	notify := func(userID int, kind string, actorID, chirpID int) {
+		if _, err := db.AddNotification(userID, kind, actorID, chirpID); err != nil && !errors.Is(err, ErrNotFound) {
+			log.Printf("Error adding %s notification for user %d: %v", kind, userID, err)
+		}
+	}
+
+	bus.SubscribeAsync(EventChirpCreated, func(event Event) {
+		chirp := event.(ChirpCreated).Chirp
+		users, err := db.MentionedUsers(chirp)
+		if err != nil {
+			log.Printf("Error resolving mentions in chirp %d: %v", chirp.ID, err)
+			return
+		}
+		for _, user := range users {
+			notify(user.ID, NotificationMention, chirp.AuthorID, chirp.ID)
+		}
+	})
+	bus.SubscribeAsync(EventChirpDeleted, func(event Event) {
+		// only tell authors about chirps someone else removed
+		e := event.(ChirpDeleted)
+		if e.ActorID != e.Chirp.AuthorID {
+			notify(e.Chirp.AuthorID, NotificationChirpRemoved, 0, e.Chirp.ID)
+		}
+	})
+	bus.SubscribeAsync(EventUserUpgraded, func(event Event) {
+		notify(event.(UserUpgraded).User.ID, NotificationUpgraded, 0, 0)
+	})
+	bus.SubscribeAsync(EventUserDowngraded, func(event Event) {
+		notify(event.(UserDowngraded).User.ID, NotificationDowngraded, 0, 0)
+	})
+}
+
+func (cfg *apiConfig) handlerGetNotifications(w http.ResponseWriter, r *http.Request) {
+	userID, err := cfg.getAuthenticatedUserID(r)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	query := r.URL.Query()
+	limit := defaultNotificationLimit
+	if v := query.Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxNotificationsPerUser {
+			respondWithError(w, http.StatusBadRequest, "Invalid limit")
+			return
+		}
+	}
+	unreadOnly := query.Get("unread") == "true"
+
+	notifications, unread, err := cfg.database.GetNotifications(userID, unreadOnly, limit)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not retrieve notifications")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, struct {
+		UnreadCount   int            `json:"unread_count"`
+		Notifications []Notification `json:"notifications"`
+	}{unread, notifications})
+}
+
+func (cfg *apiConfig) handlerGetUnreadCount(w http.ResponseWriter, r *http.Request) {
+	userID, err := cfg.getAuthenticatedUserID(r)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+	unread, err := cfg.database.UnreadNotificationCount(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not count notifications")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]int{"unread_count": unread})
+}
+
+// handlerMarkNotificationsRead marks the listed notifications read, or
+// all of them without a body
+func (cfg *apiConfig) handlerMarkNotificationsRead(w http.ResponseWriter, r *http.Request) {
+	userID, err := cfg.getAuthenticatedUserID(r)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	var params struct {
+		IDs []int `json:"ids"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid request body")
+			return
+		}
+	}
+
+	unread, err := cfg.database.MarkNotificationsRead(userID, params.IDs)
+	if err != nil {
+		respondWithDBError(w, err, "Notification not found")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]int{"unread_count": unread})
+}
+
+func (cfg *apiConfig) handlerMarkNotificationRead(w http.ResponseWriter, r *http.Request) {
+	notificationID, err := strconv.Atoi(chi.URLParam(r, "notificationID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid notification ID")
+		return
+	}
+	userID, err := cfg.getAuthenticatedUserID(r)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	unread, err := cfg.database.MarkNotificationsRead(userID, []int{notificationID})
+	if err != nil {
+		respondWithDBError(w, err, "Notification not found")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]int{"unread_count": unread})
+}
@@ -0,0 +1,706 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// outboundEvents are the domain events endpoints can subscribe to
+var outboundEvents = map[string]bool{
+	EventChirpCreated:   true,
+	EventChirpDeleted:   true,
+	EventUserUpgraded:   true,
+	EventUserDowngraded: true,
+	EventAll:            true,
+}
+
+const (
+	DeliveryPending   = "pending"
+	DeliverySucceeded = "succeeded"
+	DeliveryFailed    = "failed"
+
+	// maxDeliveryAttempts is how often a delivery is tried before giving up
+	maxDeliveryAttempts = 8
+	// deliveryBaseBackoff doubles after every failed attempt, up to
+	// deliveryMaxBackoff
+	deliveryBaseBackoff = 30 * time.Second
+	deliveryMaxBackoff  = 6 * time.Hour
+	// endpointDisableThreshold consecutive failed attempts disable an endpoint
+	endpointDisableThreshold = 15
+	// deliveryRetention is how long finished deliveries stay in the log
+	deliveryRetention = 30 * 24 * time.Hour
+	// dispatchInterval is how often the queue is checked for due deliveries
+	dispatchInterval = 5 * time.Second
+	// dispatchWorkers is how many endpoints are sent to at once
+	dispatchWorkers     = 16
+	deliveryTimeout     = 10 * time.Second
+	maxEndpointsPerUser = 10
+)
+
+// WebhookEndpoint is a URL that wants to be told about events. Users get
+// events about themselves and their chirps; admins can subscribe to
+// events about everyone.
+type WebhookEndpoint struct {
+	ID      int      `json:"id"`
+	OwnerID int      `json:"owner_id"`
+	URL     string   `json:"url"`
+	Events  []string `json:"events"`
+	// AllUsers endpoints receive events about every user, admins only
+	AllUsers bool `json:"all_users"`
+	// Secret signs deliveries, it is only returned when the endpoint is created
+	Secret              string    `json:"secret,omitempty"`
+	Active              bool      `json:"active"`
+	DisabledReason      string    `json:"disabled_reason,omitempty"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	CreatedAt           time.Time `json:"created_at"`
+}
+
+// wants reports whether the endpoint subscribes to an event about userID.
+// The owner is checked as they are now: suspended owners get nothing, and
+// AllUsers only counts while they are still an admin.
+func (e WebhookEndpoint) wants(eventType string, userID int, owner User) bool {
+	if !e.Active || owner.Suspended {
+		return false
+	}
+	allUsers := e.AllUsers && owner.EffectiveRole() == RoleAdmin
+	if !allUsers && e.OwnerID != userID {
+		return false
+	}
+	for _, want := range e.Events {
+		if want == EventAll || want == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookDelivery is one event queued for, or sent to, one endpoint
+type WebhookDelivery struct {
+	ID             int             `json:"id"`
+	EndpointID     int             `json:"endpoint_id"`
+	EventID        string          `json:"event_id"`
+	Event          string          `json:"event"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	NextAttemptAt  time.Time       `json:"next_attempt_at"`
+	LastStatusCode int             `json:"last_status_code,omitempty"`
+	LastError      string          `json:"last_error,omitempty"`
+	CreatedAt      time.Time       `json:"created_at"`
+	DeliveredAt    *time.Time      `json:"delivered_at,omitempty"`
+}
+
+// OutboundEvent is the body of every delivery
+type OutboundEvent struct {
+	ID        string      `json:"id"`
+	Type      string      `json:"type"`
+	CreatedAt time.Time   `json:"created_at"`
+	Data      interface{} `json:"data"`
+}
+
+// deliveryBackoff is the wait before the attempt after the given one
+func deliveryBackoff(attempts int) time.Duration {
+	backoff := deliveryBaseBackoff
+	for i := 1; i < attempts && backoff < deliveryMaxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, deliveryMaxBackoff)
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func newWebhookSecret() (string, error) {
+	secret, err := randomHex(32)
+	return "whsec_" + secret, err
+}
+
+// CreateWebhookEndpoint registers an endpoint and generates its secret
+func (db *DB) CreateWebhookEndpoint(ownerID int, rawURL string, events []string, allUsers bool) (WebhookEndpoint, error) {
+	secret, err := newWebhookSecret()
+	if err != nil {
+		return WebhookEndpoint{}, err
+	}
+
+	var endpoint WebhookEndpoint
+	err = db.update(func(dbStruct *DBStructure) error {
+		owned := 0
+		for _, e := range dbStruct.WebhookEndpoints {
+			if e.OwnerID == ownerID {
+				owned++
+			}
+		}
+		if owned >= maxEndpointsPerUser {
+			return fmt.Errorf("at most %d endpoints per user: %w", maxEndpointsPerUser, ErrConflict)
+		}
+
+		dbStruct.LastEndpointID++
+		endpoint = WebhookEndpoint{
+			ID:        dbStruct.LastEndpointID,
+			OwnerID:   ownerID,
+			URL:       rawURL,
+			Events:    events,
+			AllUsers:  allUsers,
+			Secret:    secret,
+			Active:    true,
+			CreatedAt: time.Now().UTC(),
+		}
+		dbStruct.WebhookEndpoints[endpoint.ID] = endpoint
+		return nil
+	})
+	return endpoint, err
+}
+
+// ownedEndpoint finds an endpoint belonging to ownerID. Other users'
+// endpoints are reported as missing.
+func (s *DBStructure) ownedEndpoint(endpointID, ownerID int) (WebhookEndpoint, error) {
+	endpoint, ok := s.WebhookEndpoints[endpointID]
+	if !ok || endpoint.OwnerID != ownerID {
+		return WebhookEndpoint{}, fmt.Errorf("webhook endpoint %w", ErrNotFound)
+	}
+	return endpoint, nil
+}
+
+// GetWebhookEndpoints lists a user's endpoints without their secrets
+func (db *DB) GetWebhookEndpoints(ownerID int) ([]WebhookEndpoint, error) {
+	dbStruct, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+
+	endpoints := []WebhookEndpoint{}
+	for _, endpoint := range dbStruct.WebhookEndpoints {
+		if endpoint.OwnerID == ownerID {
+			endpoint.Secret = ""
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	sort.Slice(endpoints, func(i, j int) bool { return endpoints[i].ID < endpoints[j].ID })
+	return endpoints, nil
+}
+
+// DeleteWebhookEndpoint removes an endpoint and its queued deliveries
+func (db *DB) DeleteWebhookEndpoint(endpointID, ownerID int) error {
+	return db.update(func(dbStruct *DBStructure) error {
+		if _, err := dbStruct.ownedEndpoint(endpointID, ownerID); err != nil {
+			return err
+		}
+		delete(dbStruct.WebhookEndpoints, endpointID)
+		for id, delivery := range dbStruct.WebhookDeliveries {
+			if delivery.EndpointID == endpointID {
+				delete(dbStruct.WebhookDeliveries, id)
+			}
+		}
+		return nil
+	})
+}
+
+// EnableWebhookEndpoint turns an endpoint back on after it was disabled.
+// Deliveries still pending are retried from now.
+func (db *DB) EnableWebhookEndpoint(endpointID, ownerID int) (WebhookEndpoint, error) {
+	var endpoint WebhookEndpoint
+	err := db.update(func(dbStruct *DBStructure) error {
+		var err error
+		endpoint, err = dbStruct.ownedEndpoint(endpointID, ownerID)
+		if err != nil {
+			return err
+		}
+		endpoint.Active = true
+		endpoint.DisabledReason = ""
+		endpoint.ConsecutiveFailures = 0
+		dbStruct.WebhookEndpoints[endpointID] = endpoint
+
+		now := time.Now().UTC()
+		for id, delivery := range dbStruct.WebhookDeliveries {
+			if delivery.EndpointID == endpointID && delivery.Status == DeliveryPending {
+				delivery.NextAttemptAt = now
+				dbStruct.WebhookDeliveries[id] = delivery
+			}
+		}
+		return nil
+	})
+	endpoint.Secret = ""
+	return endpoint, err
+}
+
+// GetWebhookDeliveries returns an endpoint's delivery log, newest first
+func (db *DB) GetWebhookDeliveries(endpointID, ownerID int) ([]WebhookDelivery, error) {
+	dbStruct, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := dbStruct.ownedEndpoint(endpointID, ownerID); err != nil {
+		return nil, err
+	}
+
+	deliveries := []WebhookDelivery{}
+	for _, delivery := range dbStruct.WebhookDeliveries {
+		if delivery.EndpointID == endpointID {
+			deliveries = append(deliveries, delivery)
+		}
+	}
+	sort.Slice(deliveries, func(i, j int) bool { return deliveries[i].ID > deliveries[j].ID })
+	return deliveries, nil
+}
+
+// pruneWebhookDeliveries drops finished deliveries past their retention
+func (s *DBStructure) pruneWebhookDeliveries(now time.Time) {
+	for id, delivery := range s.WebhookDeliveries {
+		if delivery.Status != DeliveryPending && delivery.CreatedAt.Before(now.Add(-deliveryRetention)) {
+			delete(s.WebhookDeliveries, id)
+		}
+	}
+}
+
+// EnqueueWebhookEvent queues a delivery of the event to every endpoint
+// that subscribes to it. userID is the user the event is about.
+func (db *DB) EnqueueWebhookEvent(eventType string, userID int, data interface{}) error {
+	eventID, err := randomHex(12)
+	if err != nil {
+		return err
+	}
+	eventID = "evt_" + eventID
+	now := time.Now().UTC()
+	payload, err := json.Marshal(OutboundEvent{
+		ID:        eventID,
+		Type:      eventType,
+		CreatedAt: now,
+		Data:      data,
+	})
+	if err != nil {
+		return err
+	}
+
+	return db.update(func(dbStruct *DBStructure) error {
+		dbStruct.pruneWebhookDeliveries(now)
+		queued := false
+		for _, endpoint := range dbStruct.WebhookEndpoints {
+			owner, ok := dbStruct.Users[endpoint.OwnerID]
+			if !ok || !endpoint.wants(eventType, userID, owner) {
+				continue
+			}
+			dbStruct.LastDeliveryID++
+			dbStruct.WebhookDeliveries[dbStruct.LastDeliveryID] = WebhookDelivery{
+				ID:            dbStruct.LastDeliveryID,
+				EndpointID:    endpoint.ID,
+				EventID:       eventID,
+				Event:         eventType,
+				Payload:       payload,
+				Status:        DeliveryPending,
+				NextAttemptAt: now,
+				CreatedAt:     now,
+			}
+			queued = true
+		}
+		if !queued {
+			return errNoChanges
+		}
+		return nil
+	})
+}
+
+// outboundPayload picks what endpoints are told about an event and which
+// user it concerns. ok is false for events that aren't sent out.
+func outboundPayload(event Event) (userID int, data interface{}, ok bool) {
+	switch e := event.(type) {
+	case ChirpCreated:
+		return e.Chirp.AuthorID, e.Chirp, true
+	case ChirpDeleted:
+		return e.Chirp.AuthorID, map[string]int{"id": e.Chirp.ID, "author_id": e.Chirp.AuthorID}, true
+	case UserUpgraded:
+		return e.User.ID, map[string]interface{}{"user_id": e.User.ID, "plan": e.User.Plan()}, true
+	case UserDowngraded:
+		return e.User.ID, map[string]interface{}{"user_id": e.User.ID, "plan": e.User.Plan()}, true
+	}
+	return 0, nil, false
+}
+
+// subscribeOutboundWebhooks queues deliveries for domain events. It runs
+// async so a slow queue write doesn't hold up the request.
+func subscribeOutboundWebhooks(bus *EventBus, db *DB) {
+	bus.SubscribeAsync(EventAll, func(event Event) {
+		userID, data, ok := outboundPayload(event)
+		if !ok {
+			return
+		}
+		err := db.EnqueueWebhookEvent(event.EventName(), userID, data)
+		if err != nil && !errors.Is(err, errNoChanges) {
+			log.Printf("Error queueing %s webhook: %v", event.EventName(), err)
+		}
+	})
+}
+
+// dueDelivery is a delivery together with where it goes
+type dueDelivery struct {
+	WebhookDelivery
+	URL    string
+	Secret string
+}
+
+// DueWebhookDeliveries returns pending deliveries to active endpoints of
+// owners who aren't suspended, whose next attempt is due
+func (db *DB) DueWebhookDeliveries(now time.Time) ([]dueDelivery, error) {
+	dbStruct, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+
+	var due []dueDelivery
+	for _, delivery := range dbStruct.WebhookDeliveries {
+		if delivery.Status != DeliveryPending || delivery.NextAttemptAt.After(now) {
+			continue
+		}
+		endpoint, ok := dbStruct.WebhookEndpoints[delivery.EndpointID]
+		if !ok || !endpoint.Active {
+			continue
+		}
+		// deliveries queued before the owner was suspended wait too
+		if owner, ok := dbStruct.Users[endpoint.OwnerID]; !ok || owner.Suspended {
+			continue
+		}
+		due = append(due, dueDelivery{WebhookDelivery: delivery, URL: endpoint.URL, Secret: endpoint.Secret})
+	}
+	// oldest first so events arrive roughly in order
+	sort.Slice(due, func(i, j int) bool { return due[i].ID < due[j].ID })
+	return due, nil
+}
+
+// RecordDeliveryAttempt stores the result of sending a delivery, schedules
+// a retry or gives up, and disables endpoints that keep failing
+func (db *DB) RecordDeliveryAttempt(deliveryID, statusCode int, sendErr error) error {
+	return db.update(func(dbStruct *DBStructure) error {
+		delivery, ok := dbStruct.WebhookDeliveries[deliveryID]
+		if !ok {
+			// the endpoint was deleted while we were sending
+			return nil
+		}
+		endpoint := dbStruct.WebhookEndpoints[delivery.EndpointID]
+		now := time.Now().UTC()
+
+		delivery.Attempts++
+		delivery.LastStatusCode = statusCode
+		delivery.LastError = ""
+		if sendErr == nil {
+			delivery.Status = DeliverySucceeded
+			delivery.DeliveredAt = &now
+			endpoint.ConsecutiveFailures = 0
+		} else {
+			delivery.LastError = sendErr.Error()
+			if delivery.Attempts >= maxDeliveryAttempts {
+				delivery.Status = DeliveryFailed
+			} else {
+				delivery.NextAttemptAt = now.Add(deliveryBackoff(delivery.Attempts))
+			}
+			endpoint.ConsecutiveFailures++
+			if endpoint.Active && endpoint.ConsecutiveFailures >= endpointDisableThreshold {
+				endpoint.Active = false
+				endpoint.DisabledReason = fmt.Sprintf("disabled after %d consecutive failed deliveries", endpoint.ConsecutiveFailures)
+			}
+		}
+
+		dbStruct.WebhookDeliveries[deliveryID] = delivery
+		if endpoint.ID != 0 {
+			dbStruct.WebhookEndpoints[endpoint.ID] = endpoint
+		}
+		return nil
+	})
+}
+
+// webhookClient doesn't follow redirects, a delivery goes where it was
+// registered to go or fails. It also refuses to connect to loopback,
+// private and link-local addresses. That is checked on every dial, after
+// DNS resolution, so a hostname can't be rebound to one after it was
+// registered.
+var webhookClient = &http.Client{
+	Timeout: deliveryTimeout,
+	Transport: &http.Transport{
+		// a proxy would make every dial look like the proxy's address
+		Proxy: nil,
+		DialContext: (&net.Dialer{
+			Timeout: deliveryTimeout,
+			Control: webhookDialControl,
+		}).DialContext,
+		TLSHandshakeTimeout: deliveryTimeout,
+		MaxIdleConnsPerHost: 2,
+		IdleConnTimeout:     90 * time.Second,
+	},
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// errBlockedAddress is what a delivery to an internal address fails with
+var errBlockedAddress = errors.New("endpoint address is not allowed")
+
+// sharedAddressSpace is carrier-grade NAT space, internal like RFC 1918
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// blockedWebhookAddr reports whether deliveries may not go to addr
+func blockedWebhookAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return addr.IsLoopback() || addr.IsPrivate() || addr.IsUnspecified() ||
+		addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() ||
+		addr.IsInterfaceLocalMulticast() || addr.IsMulticast() ||
+		sharedAddressSpace.Contains(addr)
+}
+
+// webhookDialControl runs right before each connection is made, with
+// the resolved address
+func webhookDialControl(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil || blockedWebhookAddr(addrPort.Addr()) {
+		return errBlockedAddress
+	}
+	return nil
+}
+
+// sendDelivery posts a signed delivery. Anything but a 2xx is a failure.
+func sendDelivery(delivery dueDelivery) (int, error) {
+	timestamp := time.Now().Unix()
+	req, err := http.NewRequest(http.MethodPost, delivery.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Chirpy-Webhooks/1")
+	req.Header.Set("X-Chirpy-Event", delivery.Event)
+	req.Header.Set("X-Chirpy-Delivery", strconv.Itoa(delivery.ID))
+	req.Header.Set("X-Chirpy-Timestamp", strconv.FormatInt(timestamp, 10))
+	req.Header.Set("X-Chirpy-Signature", signWebhook(delivery.Secret, timestamp, delivery.Payload))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("endpoint responded %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// runWebhookDispatcher sends due deliveries until the process exits.
+// The queue lives in the database, so nothing is lost on restart.
+// Endpoints are served in parallel by up to dispatchWorkers goroutines,
+// each sending one endpoint's deliveries in order, so a hanging endpoint
+// only holds up its own queue.
+func runWebhookDispatcher(db *DB, interval time.Duration) {
+	var mu sync.Mutex
+	// busy holds endpoints that still have a worker from an earlier tick
+	busy := make(map[int]bool)
+	workers := make(chan struct{}, dispatchWorkers)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		due, err := db.DueWebhookDeliveries(time.Now().UTC())
+		if err != nil {
+			log.Printf("Error loading webhook queue: %v", err)
+			continue
+		}
+
+		byEndpoint := make(map[int][]dueDelivery)
+		for _, delivery := range due {
+			byEndpoint[delivery.EndpointID] = append(byEndpoint[delivery.EndpointID], delivery)
+		}
+		for endpointID, deliveries := range byEndpoint {
+			mu.Lock()
+			if busy[endpointID] {
+				mu.Unlock()
+				continue
+			}
+			busy[endpointID] = true
+			mu.Unlock()
+
+			workers <- struct{}{}
+			go func(endpointID int, deliveries []dueDelivery) {
+				defer func() {
+					mu.Lock()
+					delete(busy, endpointID)
+					mu.Unlock()
+					<-workers
+				}()
+				sendEndpointDeliveries(db, deliveries)
+			}(endpointID, deliveries)
+		}
+	}
+}
+
+// sendEndpointDeliveries sends one endpoint's due deliveries in order. It
+// stops at the first failure, the rest are tried again on a later tick
+// rather than each waiting out the timeout now.
+func sendEndpointDeliveries(db *DB, deliveries []dueDelivery) {
+	for _, delivery := range deliveries {
+		statusCode, sendErr := sendDelivery(delivery)
+		if err := db.RecordDeliveryAttempt(delivery.ID, statusCode, sendErr); err != nil {
+			log.Printf("Error recording webhook delivery %d: %v", delivery.ID, err)
+		}
+		if sendErr != nil {
+			return
+		}
+	}
+}
+
+// validateEndpointRequest checks the URL and event filter of a new endpoint
+func validateEndpointRequest(rawURL string, events []string) FieldErrors {
+	fieldErrors := FieldErrors{}
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		fieldErrors["url"] = "must be an http or https URL"
+	} else if blockedWebhookHost(u.Hostname()) {
+		fieldErrors["url"] = "must not point at a local or private address"
+	}
+	if len(events) == 0 {
+		fieldErrors["events"] = "must list at least one event"
+	}
+	for _, event := range events {
+		if !outboundEvents[event] {
+			fieldErrors["events"] = fmt.Sprintf("unknown event %q", event)
+		}
+	}
+	return fieldErrors
+}
+
+// blockedWebhookHost catches obviously internal hosts when an endpoint is
+// registered. Hostnames are checked again when deliveries are sent.
+func blockedWebhookHost(host string) bool {
+	if strings.EqualFold(host, "localhost") || strings.HasSuffix(strings.ToLower(host), ".localhost") {
+		return true
+	}
+	addr, err := netip.ParseAddr(host)
+	return err == nil && blockedWebhookAddr(addr)
+}
+
+func (cfg *apiConfig) handlerCreateWebhookEndpoint(w http.ResponseWriter, r *http.Request) {
+	userID, err := cfg.getAuthenticatedUserID(r)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	var endpointRequest struct {
+		URL      string   `json:"url"`
+		Events   []string `json:"events"`
+		AllUsers bool     `json:"all_users"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&endpointRequest); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if fieldErrors := validateEndpointRequest(endpointRequest.URL, endpointRequest.Events); len(fieldErrors) > 0 {
+		respondWithValidationErrors(w, fieldErrors)
+		return
+	}
+	if endpointRequest.AllUsers {
+		user, err := cfg.database.GetUserByID(userID)
+		if err != nil {
+			respondWithDBError(w, err, "User not found")
+			return
+		}
+		if user.EffectiveRole() != RoleAdmin {
+			respondWithError(w, http.StatusForbidden, "Only admins can subscribe to events about all users")
+			return
+		}
+	}
+
+	endpoint, err := cfg.database.CreateWebhookEndpoint(userID, endpointRequest.URL, endpointRequest.Events, endpointRequest.AllUsers)
+	if err != nil {
+		respondWithDBError(w, err, "Failed to create webhook endpoint")
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, endpoint)
+}
+
+func (cfg *apiConfig) handlerGetWebhookEndpoints(w http.ResponseWriter, r *http.Request) {
+	userID, err := cfg.getAuthenticatedUserID(r)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	endpoints, err := cfg.database.GetWebhookEndpoints(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not retrieve webhook endpoints")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, endpoints)
+}
+
+// endpointRequestIDs reads the caller and the endpoint ID from the URL
+func (cfg *apiConfig) endpointRequestIDs(w http.ResponseWriter, r *http.Request) (userID, endpointID int, ok bool) {
+	endpointID, err := strconv.Atoi(chi.URLParam(r, "endpointID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid endpoint ID")
+		return 0, 0, false
+	}
+	userID, err = cfg.getAuthenticatedUserID(r)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return 0, 0, false
+	}
+	return userID, endpointID, true
+}
+
+func (cfg *apiConfig) handlerDeleteWebhookEndpoint(w http.ResponseWriter, r *http.Request) {
+	userID, endpointID, ok := cfg.endpointRequestIDs(w, r)
+	if !ok {
+		return
+	}
+	if err := cfg.database.DeleteWebhookEndpoint(endpointID, userID); err != nil {
+		respondWithDBError(w, err, "Webhook endpoint not found")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (cfg *apiConfig) handlerEnableWebhookEndpoint(w http.ResponseWriter, r *http.Request) {
+	userID, endpointID, ok := cfg.endpointRequestIDs(w, r)
+	if !ok {
+		return
+	}
+	endpoint, err := cfg.database.EnableWebhookEndpoint(endpointID, userID)
+	if err != nil {
+		respondWithDBError(w, err, "Webhook endpoint not found")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, endpoint)
+}
+
+func (cfg *apiConfig) handlerGetWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	userID, endpointID, ok := cfg.endpointRequestIDs(w, r)
+	if !ok {
+		return
+	}
+	deliveries, err := cfg.database.GetWebhookDeliveries(endpointID, userID)
+	if err != nil {
+		respondWithDBError(w, err, "Webhook endpoint not found")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, deliveries)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+	"unicode/utf8"
+)
+
+// Plan is the subscription tier a user is on
+type Plan string
+
+const (
+	PlanFree Plan = "free"
+	PlanRed  Plan = "red"
+)
+
+// Entitlements are the limits and features that come with a plan
+type Entitlements struct {
+	// MaxChirpLength is counted in characters
+	MaxChirpLength int `json:"max_chirp_length"`
+	// EditWindow is how long after posting a chirp can be edited, 0 means never
+	EditWindow time.Duration `json:"-"`
+	// ChirpsPerHour caps chirp creation, 0 means unlimited
+	ChirpsPerHour int `json:"chirps_per_hour"`
+	// MediaPerChirp is how many images a chirp can carry, 0 disables uploads
+	MediaPerChirp int `json:"media_per_chirp"`
+}
+
+// planEntitlements is the one place plan limits are configured
+var planEntitlements = map[Plan]Entitlements{
+	PlanFree: {
+		MaxChirpLength: 140,
+		EditWindow:     0,
+		ChirpsPerHour:  30,
+		MediaPerChirp:  0,
+	},
+	PlanRed: {
+		MaxChirpLength: 500,
+		EditWindow:     15 * time.Minute,
+		ChirpsPerHour:  300,
+		MediaPerChirp:  maxChirpMedia,
+	},
+}
+
+// ErrQuotaExceeded -
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// Plan returns the plan the user is currently on. A lapsed subscription
+// counts as free even before the sweeper has expired it.
+func (u User) Plan() Plan {
+	if u.hasRed(time.Now().UTC()) {
+		return PlanRed
+	}
+	return PlanFree
+}
+
+// Entitlements returns the limits of the user's plan
+func (u User) Entitlements() Entitlements {
+	return planEntitlements[u.Plan()]
+}
+
+// checkChirpLength fails if body is too long for the plan
+func (e Entitlements) checkChirpLength(body string) error {
+	if utf8.RuneCountInString(body) > e.MaxChirpLength {
+		return fmt.Errorf("chirp is longer than %d characters: %w", e.MaxChirpLength, ErrInvalidInput)
+	}
+	return nil
+}
+
+// countRecentChirps counts chirps by userID created after since
+func (s *DBStructure) countRecentChirps(userID int, since time.Time) int {
+	count := 0
+	for _, chirp := range s.Chirps {
+		if chirp.AuthorID == userID && chirp.CreatedAt.After(since) {
+			count++
+		}
+	}
+	return count
+}
+
+// entitlementsFor loads a user and their plan limits
+func (cfg *apiConfig) entitlementsFor(userID int) (User, Entitlements, error) {
+	user, err := cfg.database.GetUserByID(userID)
+	if err != nil {
+		return User{}, Entitlements{}, err
+	}
+	return user, user.Entitlements(), nil
+}
+
+// PlanInfo describes a user's plan in API responses
+type PlanInfo struct {
+	Plan              Plan `json:"plan"`
+	EditWindowSeconds int  `json:"edit_window_seconds"`
+	Entitlements
+}
+
+func planInfo(user User) PlanInfo {
+	e := user.Entitlements()
+	return PlanInfo{
+		Plan:              user.Plan(),
+		EditWindowSeconds: int(e.EditWindow / time.Second),
+		Entitlements:      e,
+	}
+}
+
+// respondWithPlanRequired answers requests for features the user's plan
+// doesn't include
+func respondWithPlanRequired(w http.ResponseWriter, feature string) {
+	respondWithProblem(w, http.StatusForbidden, "plan_required", feature+" requires Chirpy Red", nil)
+}
+
+// respondWithChirpError maps errors from creating or editing a chirp
+func respondWithChirpError(w http.ResponseWriter, err error, e Entitlements) {
+	switch {
+	case errors.Is(err, ErrQuotaExceeded):
+		w.Header().Set("Retry-After", "3600")
+		respondWithProblem(w, http.StatusTooManyRequests, "chirp_quota_exceeded",
+			fmt.Sprintf("Your plan allows %d chirps per hour", e.ChirpsPerHour), nil)
+	case errors.Is(err, ErrInvalidInput):
+		respondWithValidationErrors(w, FieldErrors{
+			"body": fmt.Sprintf("must be at most %d characters", e.MaxChirpLength),
+		})
+	default:
+		respondWithDBError(w, err, "Could not save chirp")
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	maxDisplayNameLength = 50
+	maxBioLength         = 160
+	maxAvatarURLLength   = 2048
+)
+
+// PublicProfile is what anyone can see about a user
+type PublicProfile struct {
+	ID          int        `json:"id"`
+	Handle      string     `json:"handle"`
+	DisplayName string     `json:"display_name"`
+	Bio         string     `json:"bio"`
+	AvatarURL   string     `json:"avatar_url"`
+	IsChirpyRed bool       `json:"is_chirpy_red"`
+	ChirpCount  int        `json:"chirp_count"`
+	JoinedAt    *time.Time `json:"joined_at,omitempty"`
+}
+
+// OwnProfile adds the private fields a user sees about themselves
+type OwnProfile struct {
+	PublicProfile
+	Email         string        `json:"email"`
+	EmailVerified bool          `json:"email_verified"`
+	Role          Role          `json:"role"`
+	TOTPEnabled   bool          `json:"totp_enabled"`
+	Plan          PlanInfo      `json:"plan"`
+	Subscription  *Subscription `json:"subscription,omitempty"`
+}
+
+// publicProfile builds the profile for a user from the loaded database
+func (s *DBStructure) publicProfile(user User) PublicProfile {
+	profile := PublicProfile{
+		ID:          user.ID,
+		Handle:      user.Handle,
+		DisplayName: user.DisplayName,
+		Bio:         user.Bio,
+		AvatarURL:   user.AvatarURL,
+		IsChirpyRed: user.Plan() == PlanRed,
+	}
+	if !user.CreatedAt.IsZero() {
+		joined := user.CreatedAt
+		profile.JoinedAt = &joined
+	}
+	for _, chirp := range s.Chirps {
+		if chirp.AuthorID == user.ID && !chirp.Hidden {
+			profile.ChirpCount++
+		}
+	}
+	return profile
+}
+
+// GetUserProfile returns the public profile of a user
+func (db *DB) GetUserProfile(userID int) (User, PublicProfile, error) {
+	dbStruct, err := db.loadDB()
+	if err != nil {
+		return User{}, PublicProfile{}, err
+	}
+
+	user, ok := dbStruct.Users[userID]
+	if !ok {
+		return User{}, PublicProfile{}, fmt.Errorf("user %w", ErrNotFound)
+	}
+	return user, dbStruct.publicProfile(user), nil
+}
+
+// validateProfileFields checks and trims the editable profile fields
+// in place, adding any problems to fieldErrors
+func validateProfileFields(displayName, bio, avatarURL *string, fieldErrors FieldErrors) {
+	if displayName != nil {
+		*displayName = strings.TrimSpace(*displayName)
+		if utf8.RuneCountInString(*displayName) > maxDisplayNameLength {
+			fieldErrors["display_name"] = fmt.Sprintf("must be at most %d characters", maxDisplayNameLength)
+		}
+	}
+	if bio != nil {
+		*bio = strings.TrimSpace(*bio)
+		if utf8.RuneCountInString(*bio) > maxBioLength {
+			fieldErrors["bio"] = fmt.Sprintf("must be at most %d characters", maxBioLength)
+		}
+	}
+	if avatarURL != nil && *avatarURL != "" {
+		*avatarURL = strings.TrimSpace(*avatarURL)
+		u, err := url.Parse(*avatarURL)
+		switch {
+		case len(*avatarURL) > maxAvatarURLLength:
+			fieldErrors["avatar_url"] = fmt.Sprintf("must be at most %d characters", maxAvatarURLLength)
+		case err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "":
+			fieldErrors["avatar_url"] = "must be an http or https URL"
+		}
+	}
+}
+
+func (cfg *apiConfig) handlerGetUser(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(chi.URLParam(r, "userID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+
+	_, profile, err := cfg.database.GetUserProfile(userID)
+	if err != nil {
+		respondWithDBError(w, err, "User not found")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, profile)
+}
+
+func (cfg *apiConfig) handlerGetMe(w http.ResponseWriter, r *http.Request) {
+	userID, err := cfg.getAuthenticatedUserID(r)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	user, profile, err := cfg.database.GetUserProfile(userID)
+	if err != nil {
+		respondWithDBError(w, err, "User not found")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, OwnProfile{
+		PublicProfile: profile,
+		Email:         user.Email,
+		EmailVerified: user.EmailVerified,
+		Role:          user.EffectiveRole(),
+		TOTPEnabled:   user.TOTPEnabled,
+		Plan:          planInfo(user),
+		Subscription:  user.Subscription,
+	})
+}
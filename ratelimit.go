@@ -0,0 +1,155 @@
+package main
+
+import (
+	"container/list"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxRateLimitBuckets bounds the limiter's memory. The least recently
+// used bucket goes first, which is nearly always a full one that would
+// behave the same if it were created again.
+const maxRateLimitBuckets = 10000
+
+// RateLimitPolicy is a token bucket: Burst requests at once, with one
+// more allowed every Every
+type RateLimitPolicy struct {
+	// Name keeps buckets of different routes apart
+	Name  string
+	Burst int
+	Every time.Duration
+	// ByIP always keys on the client IP. Routes anyone can call without
+	// logging in need it, or each token would get its own bucket.
+	ByIP bool
+}
+
+// Rate limits for routes that are cheap to abuse. Plans still cap how
+// many chirps are posted per hour on top of this.
+var (
+	chirpRateLimit  = RateLimitPolicy{Name: "chirps", Burst: 10, Every: 6 * time.Second}
+	loginRateLimit  = RateLimitPolicy{Name: "login", Burst: 10, Every: 6 * time.Second, ByIP: true}
+	signupRateLimit = RateLimitPolicy{Name: "signup", Burst: 5, Every: 12 * time.Minute, ByIP: true}
+	// twoFactorRateLimit covers routes that check a code for a logged in
+	// user, on top of the login lockout
+	twoFactorRateLimit = RateLimitPolicy{Name: "2fa", Burst: 5, Every: time.Minute}
+	// emailRateLimit covers routes that send mail to the caller
+	emailRateLimit = RateLimitPolicy{Name: "email", Burst: 3, Every: 10 * time.Minute}
+	// passwordResetRateLimit sends mail to whatever address is asked for
+	passwordResetRateLimit = RateLimitPolicy{Name: "password_reset", Burst: 3, Every: 10 * time.Minute, ByIP: true}
+)
+
+type tokenBucket struct {
+	key     string
+	tokens  float64
+	updated time.Time
+}
+
+// RateLimiter holds token buckets in memory, up to maxBuckets of them
+type RateLimiter struct {
+	mu         sync.Mutex
+	maxBuckets int
+	buckets    map[string]*list.Element
+	// lru has the most recently used bucket at the front
+	lru *list.List
+}
+
+// NewRateLimiter -
+func NewRateLimiter(maxBuckets int) *RateLimiter {
+	return &RateLimiter{
+		maxBuckets: maxBuckets,
+		buckets:    make(map[string]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+// RateLimitResult is the outcome of taking a token
+type RateLimitResult struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// RetryAfter is how long until the next token, when not allowed
+	RetryAfter time.Duration
+	// Reset is how long until the bucket is full again
+	Reset time.Duration
+}
+
+// Take takes a token from key's bucket if there is one
+func (l *RateLimiter) Take(key string, policy RateLimitPolicy, now time.Time) RateLimitResult {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	bucketKey := policy.Name + "|" + key
+	var bucket *tokenBucket
+	if elem, ok := l.buckets[bucketKey]; ok {
+		l.lru.MoveToFront(elem)
+		bucket = elem.Value.(*tokenBucket)
+		refill := float64(now.Sub(bucket.updated)) / float64(policy.Every)
+		bucket.tokens = math.Min(float64(policy.Burst), bucket.tokens+refill)
+	} else {
+		bucket = &tokenBucket{key: bucketKey, tokens: float64(policy.Burst)}
+		l.buckets[bucketKey] = l.lru.PushFront(bucket)
+		for len(l.buckets) > l.maxBuckets {
+			oldest := l.lru.Back()
+			l.lru.Remove(oldest)
+			delete(l.buckets, oldest.Value.(*tokenBucket).key)
+		}
+	}
+	bucket.updated = now
+
+	result := RateLimitResult{Limit: policy.Burst}
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = time.Duration((1 - bucket.tokens) * float64(policy.Every))
+	}
+	result.Remaining = int(bucket.tokens)
+	result.Reset = time.Duration((float64(policy.Burst) - bucket.tokens) * float64(policy.Every))
+	return result
+}
+
+// ceilSeconds rounds up to whole seconds for headers
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// rateLimitKey is the authenticated user if the request carries a valid
+// access token, the client IP otherwise or for ByIP policies. The token
+// is only checked for its signature here, the handler still does the
+// real authentication.
+func (cfg *apiConfig) rateLimitKey(r *http.Request, policy RateLimitPolicy) string {
+	if policy.ByIP {
+		return "ip:" + clientIP(r)
+	}
+	if tokenString, err := GetBearerToken(r.Header); err == nil {
+		if userID, err := ValidateJWT(tokenString, cfg.jwtSecret); err == nil {
+			return "user:" + userID
+		}
+	}
+	return "ip:" + clientIP(r)
+}
+
+// middlewareRateLimit limits requests to a route with policy, per user or
+// per IP (see rateLimitKey). Responses carry X-RateLimit-Limit, X-RateLimit-Remaining and
+// X-RateLimit-Reset (seconds until the bucket is full); rejected ones get
+// 429 with Retry-After.
+func (cfg *apiConfig) middlewareRateLimit(policy RateLimitPolicy) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			result := cfg.rateLimiter.Take(cfg.rateLimitKey(r, policy), policy, time.Now())
+
+			w.Header().Set("X-RateLimit-Limit", strconv.Itoa(result.Limit))
+			w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(result.Remaining))
+			w.Header().Set("X-RateLimit-Reset", strconv.Itoa(ceilSeconds(result.Reset)))
+			if !result.Allowed {
+				w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(result.RetryAfter)))
+				respondWithProblem(w, http.StatusTooManyRequests, "rate_limited", "Too many requests, slow down", nil)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
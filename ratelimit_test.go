@@ -0,0 +1,171 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// rateLimitStep is one Take call, at an offset from the test's start
+type rateLimitStep struct {
+	key        string
+	at         time.Duration
+	allowed    bool
+	remaining  int
+	retryAfter time.Duration
+}
+
+func runRateLimitSteps(t *testing.T, limiter *RateLimiter, policy RateLimitPolicy, steps []rateLimitStep) {
+	t.Helper()
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, step := range steps {
+		got := limiter.Take(step.key, policy, start.Add(step.at))
+		if got.Allowed != step.allowed || got.Remaining != step.remaining || got.RetryAfter != step.retryAfter {
+			t.Errorf("step %d (%s at %v): got allowed=%v remaining=%d retry=%v, want allowed=%v remaining=%d retry=%v",
+				i, step.key, step.at, got.Allowed, got.Remaining, got.RetryAfter, step.allowed, step.remaining, step.retryAfter)
+		}
+		if got.Limit != policy.Burst {
+			t.Errorf("step %d: got limit %d, want %d", i, got.Limit, policy.Burst)
+		}
+	}
+}
+
+func TestRateLimiterTake(t *testing.T) {
+	policy := RateLimitPolicy{Name: "test", Burst: 3, Every: 10 * time.Second}
+	tests := []struct {
+		name  string
+		steps []rateLimitStep
+	}{
+		{
+			name: "burst then denied",
+			steps: []rateLimitStep{
+				{key: "a", at: 0, allowed: true, remaining: 2},
+				{key: "a", at: 0, allowed: true, remaining: 1},
+				{key: "a", at: 0, allowed: true, remaining: 0},
+				{key: "a", at: 0, allowed: false, remaining: 0, retryAfter: 10 * time.Second},
+			},
+		},
+		{
+			name: "retry after counts partial refill",
+			steps: []rateLimitStep{
+				{key: "a", at: 0, allowed: true, remaining: 2},
+				{key: "a", at: 0, allowed: true, remaining: 1},
+				{key: "a", at: 0, allowed: true, remaining: 0},
+				{key: "a", at: 2500 * time.Millisecond, allowed: false, remaining: 0, retryAfter: 7500 * time.Millisecond},
+				{key: "a", at: 5 * time.Second, allowed: false, remaining: 0, retryAfter: 5 * time.Second},
+			},
+		},
+		{
+			name: "refills one token per interval",
+			steps: []rateLimitStep{
+				{key: "a", at: 0, allowed: true, remaining: 2},
+				{key: "a", at: 0, allowed: true, remaining: 1},
+				{key: "a", at: 0, allowed: true, remaining: 0},
+				{key: "a", at: 10 * time.Second, allowed: true, remaining: 0},
+				{key: "a", at: 30 * time.Second, allowed: true, remaining: 1},
+			},
+		},
+		{
+			name: "refill stops at the burst",
+			steps: []rateLimitStep{
+				{key: "a", at: 0, allowed: true, remaining: 2},
+				{key: "a", at: time.Hour, allowed: true, remaining: 2},
+			},
+		},
+		{
+			name: "keys have their own buckets",
+			steps: []rateLimitStep{
+				{key: "a", at: 0, allowed: true, remaining: 2},
+				{key: "a", at: 0, allowed: true, remaining: 1},
+				{key: "a", at: 0, allowed: true, remaining: 0},
+				{key: "b", at: 0, allowed: true, remaining: 2},
+				{key: "a", at: 0, allowed: false, remaining: 0, retryAfter: 10 * time.Second},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runRateLimitSteps(t, NewRateLimiter(maxRateLimitBuckets), policy, tt.steps)
+		})
+	}
+}
+
+func TestRateLimiterPoliciesAreSeparate(t *testing.T) {
+	limiter := NewRateLimiter(maxRateLimitBuckets)
+	now := time.Now()
+	one := RateLimitPolicy{Name: "one", Burst: 1, Every: time.Hour}
+	other := RateLimitPolicy{Name: "other", Burst: 1, Every: time.Hour}
+	if !limiter.Take("a", one, now).Allowed {
+		t.Fatal("first take denied")
+	}
+	if !limiter.Take("a", other, now).Allowed {
+		t.Fatal("other policy shares the bucket")
+	}
+	if limiter.Take("a", one, now).Allowed {
+		t.Fatal("empty bucket allowed a take")
+	}
+}
+
+func TestRateLimiterEvictsLeastRecentlyUsed(t *testing.T) {
+	// one token an hour, so a bucket only allows a second take if it was
+	// evicted and created again
+	policy := RateLimitPolicy{Name: "test", Burst: 1, Every: time.Hour}
+	denied := rateLimitStep{allowed: false, remaining: 0, retryAfter: time.Hour}
+	tests := []struct {
+		name       string
+		maxBuckets int
+		steps      []rateLimitStep
+	}{
+		{
+			name:       "oldest bucket goes first",
+			maxBuckets: 2,
+			steps: []rateLimitStep{
+				{key: "a", allowed: true},
+				{key: "b", allowed: true},
+				{key: "c", allowed: true},
+				// a was evicted for c
+				{key: "a", allowed: true},
+				// b was evicted for a, c is still there
+				withKey(denied, "c"),
+			},
+		},
+		{
+			name:       "using a bucket keeps it",
+			maxBuckets: 2,
+			steps: []rateLimitStep{
+				{key: "a", allowed: true},
+				{key: "b", allowed: true},
+				withKey(denied, "a"),
+				// b is now the least recently used
+				{key: "c", allowed: true},
+				withKey(denied, "a"),
+				{key: "b", allowed: true},
+			},
+		},
+		{
+			name:       "room for every key",
+			maxBuckets: 3,
+			steps: []rateLimitStep{
+				{key: "a", allowed: true},
+				{key: "b", allowed: true},
+				{key: "c", allowed: true},
+				withKey(denied, "a"),
+				withKey(denied, "b"),
+				withKey(denied, "c"),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter := NewRateLimiter(tt.maxBuckets)
+			runRateLimitSteps(t, limiter, policy, tt.steps)
+			if len(limiter.buckets) > tt.maxBuckets || limiter.lru.Len() != len(limiter.buckets) {
+				t.Fatalf("got %d buckets and %d list entries, want at most %d", len(limiter.buckets), limiter.lru.Len(), tt.maxBuckets)
+			}
+		})
+	}
+}
+
+func withKey(step rateLimitStep, key string) rateLimitStep {
+	step.key = key
+	return step
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	ReportOpen      = "open"
+	ReportDismissed = "dismissed"
+	ReportActioned  = "actioned"
+
+	defaultReportHideThreshold = 3
+	maxReportDetailsLength     = 1000
+)
+
+// reportCategories are the reasons a chirp can be reported for
+var reportCategories = map[string]bool{
+	"spam":           true,
+	"harassment":     true,
+	"hate":           true,
+	"violence":       true,
+	"misinformation": true,
+	"other":          true,
+}
+
+type Report struct {
+	ID         int        `json:"id"`
+	ChirpID    int        `json:"chirp_id"`
+	ReporterID int        `json:"reporter_id"`
+	Category   string     `json:"category"`
+	Details    string     `json:"details,omitempty"`
+	Status     string     `json:"status"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ResolvedAt *time.Time `json:"resolved_at,omitempty"`
+	ResolvedBy int        `json:"resolved_by,omitempty"`
+	Resolution string     `json:"resolution,omitempty"`
+}
+
+// reportHideThresholdFromEnv reads REPORT_HIDE_THRESHOLD; 0 turns hiding off
+func reportHideThresholdFromEnv() (int, error) {
+	v := os.Getenv("REPORT_HIDE_THRESHOLD")
+	if v == "" {
+		return defaultReportHideThreshold, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("REPORT_HIDE_THRESHOLD must be a non-negative number")
+	}
+	return n, nil
+}
+
+// openReportCount counts distinct reporters with an open report on a chirp
+func (s *DBStructure) openReportCount(chirpID int) int {
+	count := 0
+	for _, report := range s.Reports {
+		if report.ChirpID == chirpID && report.Status == ReportOpen {
+			count++
+		}
+	}
+	return count
+}
+
+// CreateReport files a report. A reporter with an open report on the same
+// chirp gets that report back instead of a new one. The chirp is hidden
+// once hideThreshold reporters have open reports on it.
+func (db *DB) CreateReport(chirpID, reporterID int, category, details string, hideThreshold int) (Report, bool, error) {
+	var report Report
+	created := false
+	err := db.update(func(dbStruct *DBStructure) error {
+		chirp, ok := dbStruct.Chirps[chirpID]
+		if !ok {
+			return fmt.Errorf("chirp %w", ErrNotFound)
+		}
+		if chirp.AuthorID == reporterID {
+			return fmt.Errorf("can't report your own chirp: %w", ErrInvalidInput)
+		}
+
+		for _, existing := range dbStruct.Reports {
+			if existing.ChirpID == chirpID && existing.ReporterID == reporterID && existing.Status == ReportOpen {
+				report = existing
+				return nil
+			}
+		}
+
+		report = Report{
+			ID:         len(dbStruct.Reports) + 1,
+			ChirpID:    chirpID,
+			ReporterID: reporterID,
+			Category:   category,
+			Details:    details,
+			Status:     ReportOpen,
+			CreatedAt:  time.Now().UTC(),
+		}
+		dbStruct.Reports[report.ID] = report
+		created = true
+
+		if hideThreshold > 0 && !chirp.Hidden && dbStruct.openReportCount(chirpID) >= hideThreshold {
+			chirp.Hidden = true
+			dbStruct.Chirps[chirpID] = chirp
+		}
+		return nil
+	})
+	return report, created, err
+}
+
+// GetReports returns reports with the given status, oldest first.
+// An empty status returns all reports.
+func (db *DB) GetReports(status string) ([]Report, error) {
+	dbStruct, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+
+	reports := []Report{}
+	for _, report := range dbStruct.Reports {
+		if status == "" || report.Status == status {
+			reports = append(reports, report)
+		}
+	}
+	sort.Slice(reports, func(i, j int) bool { return reports[i].ID < reports[j].ID })
+	return reports, nil
+}
+
+// resolveReports closes every open report on a chirp
+func (s *DBStructure) resolveReports(chirpID, actorID int, status, resolution string) []Report {
+	now := time.Now().UTC()
+	resolved := []Report{}
+	for id, report := range s.Reports {
+		if report.ChirpID != chirpID || report.Status != ReportOpen {
+			continue
+		}
+		report.Status = status
+		report.ResolvedAt = &now
+		report.ResolvedBy = actorID
+		report.Resolution = resolution
+		s.Reports[id] = report
+		resolved = append(resolved, report)
+	}
+	return resolved
+}
+
+// DismissReport closes a single report. A chirp that was hidden by reports
+// is shown again once no open reports are left on it.
+func (db *DB) DismissReport(reportID, actorID int, note string) (Report, error) {
+	var report Report
+	err := db.update(func(dbStruct *DBStructure) error {
+		var ok bool
+		report, ok = dbStruct.Reports[reportID]
+		if !ok {
+			return fmt.Errorf("report %w", ErrNotFound)
+		}
+		if report.Status != ReportOpen {
+			return fmt.Errorf("report already resolved: %w", ErrConflict)
+		}
+		now := time.Now().UTC()
+		report.Status = ReportDismissed
+		report.ResolvedAt = &now
+		report.ResolvedBy = actorID
+		report.Resolution = note
+		dbStruct.Reports[reportID] = report
+
+		if chirp, ok := dbStruct.Chirps[report.ChirpID]; ok && chirp.Hidden && dbStruct.openReportCount(chirp.ID) == 0 {
+			chirp.Hidden = false
+			dbStruct.Chirps[chirp.ID] = chirp
+		}
+		return nil
+	})
+	return report, err
+}
+
+// ActOnReport applies a moderation action to the reported chirp and closes
+// every open report on it. Supported actions are "hide", "delete" and
+// "suspend_author"; the last two also hide or remove the chirp. An author
+// who is already suspended counts as done, so the reports still close.
+func (db *DB) ActOnReport(reportID, actorID int, actorRole Role, action, reason string) ([]Report, error) {
+	var resolved []Report
+	var deleted []Event
+	err := db.update(func(dbStruct *DBStructure) error {
+		report, ok := dbStruct.Reports[reportID]
+		if !ok {
+			return fmt.Errorf("report %w", ErrNotFound)
+		}
+		if report.Status != ReportOpen {
+			return fmt.Errorf("report already resolved: %w", ErrConflict)
+		}
+		chirp, ok := dbStruct.Chirps[report.ChirpID]
+		if !ok {
+			return fmt.Errorf("chirp %w", ErrNotFound)
+		}
+
+		switch action {
+		case "delete":
+			if _, _, err := dbStruct.moderateDeleteChirp(chirp.ID, actorID, reason); err != nil {
+				return err
+			}
+			deleted = append(deleted, ChirpDeleted{Chirp: chirp, ActorID: actorID})
+		case "suspend_author":
+			if author, ok := dbStruct.Users[chirp.AuthorID]; !ok || !author.Suspended {
+				if _, err := dbStruct.setUserSuspended(chirp.AuthorID, actorID, actorRole, true, reason); err != nil {
+					return err
+				}
+			}
+			chirp.Hidden = true
+			dbStruct.Chirps[chirp.ID] = chirp
+		case "hide":
+			chirp.Hidden = true
+			dbStruct.Chirps[chirp.ID] = chirp
+		default:
+			return fmt.Errorf("unknown action %q: %w", action, ErrInvalidInput)
+		}
+
+		resolved = dbStruct.resolveReports(chirp.ID, actorID, ReportActioned, action+": "+reason)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	db.publish(deleted...)
+	return resolved, nil
+}
+
+func (cfg *apiConfig) handlerCreateReport(w http.ResponseWriter, r *http.Request) {
+	chirpID, err := strconv.Atoi(chi.URLParam(r, "chirpID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid chirp ID")
+		return
+	}
+	userID, err := cfg.getAuthenticatedUserID(r)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	var reportRequest struct {
+		Category string `json:"category"`
+		Details  string `json:"details"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reportRequest); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	category := strings.ToLower(strings.TrimSpace(reportRequest.Category))
+	details := strings.TrimSpace(reportRequest.Details)
+	fieldErrors := FieldErrors{}
+	if !reportCategories[category] {
+		fieldErrors["category"] = "must be one of spam, harassment, hate, violence, misinformation, other"
+	}
+	if len(details) > maxReportDetailsLength {
+		fieldErrors["details"] = fmt.Sprintf("must be at most %d characters", maxReportDetailsLength)
+	}
+	if len(fieldErrors) > 0 {
+		respondWithValidationErrors(w, fieldErrors)
+		return
+	}
+
+	report, created, err := cfg.database.CreateReport(chirpID, userID, category, details, cfg.reportHideThreshold)
+	if err != nil {
+		respondWithDBError(w, err, "Failed to report chirp")
+		return
+	}
+
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	respondWithJSON(w, status, report)
+}
+
+func (cfg *apiConfig) handlerGetReports(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = ReportOpen
+	}
+	if status == "all" {
+		status = ""
+	}
+
+	reports, err := cfg.database.GetReports(status)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not retrieve reports")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, reports)
+}
+
+func (cfg *apiConfig) handlerDismissReport(w http.ResponseWriter, r *http.Request) {
+	reportID, err := strconv.Atoi(chi.URLParam(r, "reportID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid report ID")
+		return
+	}
+	actorID, _ := contextUserID(r)
+
+	var dismissRequest struct {
+		Note string `json:"note"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&dismissRequest); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	report, err := cfg.database.DismissReport(reportID, actorID, strings.TrimSpace(dismissRequest.Note))
+	if err != nil {
+		respondWithDBError(w, err, "Failed to dismiss report")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, report)
+}
+
+func (cfg *apiConfig) handlerActOnReport(w http.ResponseWriter, r *http.Request) {
+	reportID, err := strconv.Atoi(chi.URLParam(r, "reportID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid report ID")
+		return
+	}
+	actorID, _ := contextUserID(r)
+	actorRole, _ := r.Context().Value(roleKey).(Role)
+
+	var actionRequest struct {
+		Action string `json:"action"`
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&actionRequest); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	reason := strings.TrimSpace(actionRequest.Reason)
+	if reason == "" {
+		respondWithValidationErrors(w, FieldErrors{"reason": "is required"})
+		return
+	}
+
+	resolved, err := cfg.database.ActOnReport(reportID, actorID, actorRole, actionRequest.Action, reason)
+	if err != nil {
+		respondWithDBError(w, err, "Failed to act on report")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, resolved)
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// streamBacklogSize is how many recent events are kept for clients
+	// resuming with Last-Event-ID
+	streamBacklogSize = 1000
+	// streamClientBuffer is how far a client may fall behind before it
+	// is disconnected
+	streamClientBuffer  = 64
+	streamHeartbeat     = 15 * time.Second
+	streamWriteTimeout  = 10 * time.Second
+	streamRetryInterval = 3 * time.Second
+)
+
+// streamEvent is a chirp event as sent to stream clients
+type streamEvent struct {
+	ID       uint64
+	Type     string
+	AuthorID int
+	Data     []byte
+}
+
+// streamClient is one open stream. Events are dropped into a buffered
+// channel; when it is full the client is cut off instead of blocking.
+type streamClient struct {
+	authorID int
+	events   chan streamEvent
+	// dropped is closed when the client fell too far behind or the
+	// stream was closed
+	dropped chan struct{}
+}
+
+func (c *streamClient) wants(event streamEvent) bool {
+	return c.authorID == 0 || c.authorID == event.AuthorID
+}
+
+// ChirpStream fans chirp events out to connected clients and remembers
+// the most recent ones. Event IDs are "<epoch>-<seq>": the epoch is set
+// when the process starts, so IDs from before a restart are recognised.
+type ChirpStream struct {
+	mu      sync.Mutex
+	epoch   string
+	nextID  uint64
+	backlog []streamEvent
+	clients map[*streamClient]struct{}
+	closed  bool
+}
+
+// NewChirpStream -
+func NewChirpStream() *ChirpStream {
+	return &ChirpStream{
+		epoch:   strconv.FormatInt(time.Now().UnixNano(), 36),
+		nextID:  1,
+		clients: make(map[*streamClient]struct{}),
+	}
+}
+
+// subscribeChirpStream feeds chirp events from the bus into the stream.
+// Publishing never blocks on clients, so a synchronous subscriber is fine.
+func subscribeChirpStream(bus *EventBus, stream *ChirpStream) {
+	bus.Subscribe(EventChirpCreated, stream.publish)
+	bus.Subscribe(EventChirpDeleted, stream.publish)
+}
+
+func (s *ChirpStream) publish(event Event) {
+	var authorID int
+	var data interface{}
+	switch e := event.(type) {
+	case ChirpCreated:
+		authorID, data = e.Chirp.AuthorID, e.Chirp
+	case ChirpDeleted:
+		authorID, data = e.Chirp.AuthorID, map[string]int{"id": e.Chirp.ID, "author_id": e.Chirp.AuthorID}
+	default:
+		return
+	}
+	dat, err := json.Marshal(data)
+	if err != nil {
+		log.Printf("Error marshalling stream event: %v", err)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	streamed := streamEvent{ID: s.nextID, Type: event.EventName(), AuthorID: authorID, Data: dat}
+	s.nextID++
+	s.backlog = append(s.backlog, streamed)
+	if len(s.backlog) > streamBacklogSize {
+		s.backlog = s.backlog[len(s.backlog)-streamBacklogSize:]
+	}
+
+	for client := range s.clients {
+		if !client.wants(streamed) {
+			continue
+		}
+		select {
+		case client.events <- streamed:
+		default:
+			// too slow, let the handler close the connection
+			delete(s.clients, client)
+			close(client.dropped)
+		}
+	}
+}
+
+// eventID is the SSE id of an event
+func (s *ChirpStream) eventID(event streamEvent) string {
+	return s.epoch + "-" + strconv.FormatUint(event.ID, 10)
+}
+
+// parseEventID returns the sequence number of an ID this process issued
+func (s *ChirpStream) parseEventID(id string) (uint64, bool) {
+	epoch, seq, ok := strings.Cut(id, "-")
+	if !ok || epoch != s.epoch {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(seq, 10, 64)
+	if err != nil || n >= s.nextID {
+		return 0, false
+	}
+	return n, true
+}
+
+// subscribe registers a client. With a lastEventID it also returns the
+// missed events; complete is false when some of them already left the
+// backlog, or the ID isn't one this process issued (e.g. from before a
+// restart).
+func (s *ChirpStream) subscribe(authorID int, lastEventID string) (client *streamClient, missed []streamEvent, complete bool) {
+	client = &streamClient{
+		authorID: authorID,
+		events:   make(chan streamEvent, streamClientBuffer),
+		dropped:  make(chan struct{}),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	complete = true
+	if lastEventID != "" {
+		lastID, ok := s.parseEventID(lastEventID)
+		if !ok {
+			complete = false
+		} else {
+			if lastID+1 < s.nextID && (len(s.backlog) == 0 || s.backlog[0].ID > lastID+1) {
+				complete = false
+			}
+			for _, event := range s.backlog {
+				if event.ID > lastID && client.wants(event) {
+					missed = append(missed, event)
+				}
+			}
+		}
+	}
+	if s.closed {
+		close(client.dropped)
+		return client, missed, complete
+	}
+	s.clients[client] = struct{}{}
+	return client, missed, complete
+}
+
+// Close disconnects every client, for shutting down. The server doesn't
+// cancel the requests of open streams itself.
+func (s *ChirpStream) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for client := range s.clients {
+		delete(s.clients, client)
+		close(client.dropped)
+	}
+}
+
+func (s *ChirpStream) unsubscribe(client *streamClient) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.clients, client)
+}
+
+// writeEvent writes one SSE message
+func (s *ChirpStream) writeEvent(w http.ResponseWriter, event streamEvent) error {
+	_, err := fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", s.eventID(event), event.Type, event.Data)
+	return err
+}
+
+func (cfg *apiConfig) handlerChirpStream(w http.ResponseWriter, r *http.Request) {
+	var authorID int
+	if authorIDParam := r.URL.Query().Get("author_id"); authorIDParam != "" {
+		var err error
+		authorID, err = strconv.Atoi(authorIDParam)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid author ID")
+			return
+		}
+	}
+
+	// EventSource sends Last-Event-ID when it reconnects; the query
+	// parameter is for clients that can't set headers
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("last_event_id")
+	}
+
+	rc := http.NewResponseController(w)
+	client, missed, complete := cfg.chirpStream.subscribe(authorID, lastEventID)
+	defer cfg.chirpStream.unsubscribe(client)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	// stop proxies from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	// every write gets a deadline so a stuck connection can't pin us
+	write := func(fn func() error) bool {
+		rc.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+		if err := fn(); err != nil {
+			return false
+		}
+		return rc.Flush() == nil
+	}
+
+	ok := write(func() error {
+		if _, err := fmt.Fprintf(w, "retry: %d\n\n", streamRetryInterval.Milliseconds()); err != nil {
+			return err
+		}
+		if !complete {
+			// the client missed more than we remember and should refetch
+			if _, err := fmt.Fprint(w, "event: reset\ndata: {}\n\n"); err != nil {
+				return err
+			}
+		}
+		for _, event := range missed {
+			if err := cfg.chirpStream.writeEvent(w, event); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if !ok {
+		return
+	}
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-client.dropped:
+			return
+		case event := <-client.events:
+			if !write(func() error { return cfg.chirpStream.writeEvent(w, event) }) {
+				return
+			}
+		case <-heartbeat.C:
+			if !write(func() error {
+				_, err := fmt.Fprint(w, ": heartbeat\n\n")
+				return err
+			}) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// SubscriptionStatus is where a Chirpy Red subscription is in its lifecycle
+type SubscriptionStatus string
+
+const (
+	SubscriptionActive   SubscriptionStatus = "active"
+	SubscriptionPastDue  SubscriptionStatus = "past_due"
+	SubscriptionCanceled SubscriptionStatus = "canceled"
+	SubscriptionExpired  SubscriptionStatus = "expired"
+)
+
+// Polka events that change a subscription
+const (
+	PolkaUserUpgraded      = "user.upgraded"
+	PolkaUserDowngraded    = "user.downgraded"
+	PolkaUserRenewed       = "user.renewed"
+	PolkaUserCanceled      = "user.canceled"
+	PolkaUserPaymentFailed = "user.payment_failed"
+)
+
+var subscriptionEvents = map[string]bool{
+	PolkaUserUpgraded:      true,
+	PolkaUserDowngraded:    true,
+	PolkaUserRenewed:       true,
+	PolkaUserCanceled:      true,
+	PolkaUserPaymentFailed: true,
+}
+
+const (
+	// defaultBillingPeriod is used when Polka doesn't send a period end
+	defaultBillingPeriod = 30 * 24 * time.Hour
+	// paymentGracePeriod keeps Red active for a while after a failed payment
+	// so the user has time to fix their card
+	paymentGracePeriod = 3 * 24 * time.Hour
+	// maxSubscriptionHistory is how many events are kept per user
+	maxSubscriptionHistory = 50
+	// subscriptionSweepInterval is how often lapsed subscriptions are expired
+	subscriptionSweepInterval = time.Hour
+)
+
+// Subscription is a user's Chirpy Red subscription
+type Subscription struct {
+	Status            SubscriptionStatus  `json:"status"`
+	CurrentPeriodEnd  *time.Time          `json:"current_period_end,omitempty"`
+	CancelAtPeriodEnd bool                `json:"cancel_at_period_end"`
+	History           []SubscriptionEvent `json:"history"`
+}
+
+// SubscriptionEvent is one change to a subscription
+type SubscriptionEvent struct {
+	Event     string             `json:"event"`
+	Status    SubscriptionStatus `json:"status"`
+	PeriodEnd *time.Time         `json:"period_end,omitempty"`
+	At        time.Time          `json:"at"`
+}
+
+// redUntil is when the user loses Red, zero if never
+func (s *Subscription) redUntil() time.Time {
+	if s == nil || s.CurrentPeriodEnd == nil {
+		return time.Time{}
+	}
+	if s.Status == SubscriptionPastDue {
+		return s.CurrentPeriodEnd.Add(paymentGracePeriod)
+	}
+	return *s.CurrentPeriodEnd
+}
+
+// hasRed reports whether the user has Red at the given time. Users
+// upgraded before subscriptions were tracked keep it indefinitely.
+func (u User) hasRed(now time.Time) bool {
+	if !u.IsChirpyRed {
+		return false
+	}
+	until := u.Subscription.redUntil()
+	return until.IsZero() || now.Before(until)
+}
+
+func (s *Subscription) record(event string, now time.Time) {
+	entry := SubscriptionEvent{Event: event, Status: s.Status, At: now}
+	if s.CurrentPeriodEnd != nil {
+		end := *s.CurrentPeriodEnd
+		entry.PeriodEnd = &end
+	}
+	s.History = append(s.History, entry)
+	if len(s.History) > maxSubscriptionHistory {
+		s.History = s.History[len(s.History)-maxSubscriptionHistory:]
+	}
+}
+
+// applySubscriptionEvent updates a user for a Polka event. periodEnd is
+// optional. It returns false for events that don't affect subscriptions.
+func applySubscriptionEvent(user *User, event string, periodEnd *time.Time, now time.Time) bool {
+	sub := user.Subscription
+	if sub == nil {
+		sub = &Subscription{}
+	}
+	nextPeriodEnd := func(from time.Time) *time.Time {
+		if periodEnd != nil {
+			end := periodEnd.UTC()
+			// Polka may deliver events out of order; an older event
+			// mustn't take back a period that was already paid for
+			if sub.CurrentPeriodEnd != nil && sub.CurrentPeriodEnd.After(end) {
+				end = *sub.CurrentPeriodEnd
+			}
+			return &end
+		}
+		end := from.Add(defaultBillingPeriod)
+		return &end
+	}
+
+	switch event {
+	case PolkaUserUpgraded:
+		sub.Status = SubscriptionActive
+		sub.CurrentPeriodEnd = nextPeriodEnd(now)
+		sub.CancelAtPeriodEnd = false
+		user.IsChirpyRed = true
+	case PolkaUserRenewed:
+		// extend from the end of the paid period, not from today
+		from := now
+		if sub.CurrentPeriodEnd != nil && sub.CurrentPeriodEnd.After(now) {
+			from = *sub.CurrentPeriodEnd
+		}
+		sub.Status = SubscriptionActive
+		sub.CurrentPeriodEnd = nextPeriodEnd(from)
+		sub.CancelAtPeriodEnd = false
+		user.IsChirpyRed = true
+	case PolkaUserCanceled:
+		// Red stays until the end of what was paid for
+		sub.Status = SubscriptionCanceled
+		sub.CancelAtPeriodEnd = true
+	case PolkaUserPaymentFailed:
+		sub.Status = SubscriptionPastDue
+	case PolkaUserDowngraded:
+		sub.Status = SubscriptionExpired
+		sub.CurrentPeriodEnd = &now
+		sub.CancelAtPeriodEnd = false
+		user.IsChirpyRed = false
+	default:
+		return false
+	}
+
+	sub.record(event, now)
+	user.Subscription = sub
+	return true
+}
+
+// ApplySubscriptionEvent records a Polka event against a user
+func (db *DB) ApplySubscriptionEvent(userID int, event string, periodEnd *time.Time) (User, error) {
+	if !subscriptionEvents[event] {
+		return User{}, fmt.Errorf("event %q: %w", event, ErrInvalidInput)
+	}
+	var wasRed, wasFlagged bool
+	user, err := db.modifyUser(userID, func(user *User) error {
+		now := time.Now().UTC()
+		wasRed, wasFlagged = user.hasRed(now), user.IsChirpyRed
+		if !applySubscriptionEvent(user, event, periodEnd, now) {
+			return fmt.Errorf("event %q: %w", event, ErrInvalidInput)
+		}
+		return nil
+	})
+	if err != nil {
+		return User{}, err
+	}
+
+	// a lapsed user the sweeper hasn't reached yet is still flagged, so
+	// clearing the flag counts as a downgrade too
+	switch isRed := user.hasRed(time.Now().UTC()); {
+	case isRed && !wasRed:
+		db.publish(UserUpgraded{User: user})
+	case wasRed && !isRed, wasFlagged && !user.IsChirpyRed:
+		db.publish(UserDowngraded{User: user})
+	}
+	return user, nil
+}
+
+// ExpireSubscriptions takes Red away from users whose paid period, plus
+// any grace period, is over. It returns how many users were expired.
+func (db *DB) ExpireSubscriptions(now time.Time) (int, error) {
+	var expired []Event
+	err := db.update(func(dbStruct *DBStructure) error {
+		for id, user := range dbStruct.Users {
+			if !user.IsChirpyRed || user.hasRed(now) {
+				continue
+			}
+			user.IsChirpyRed = false
+			user.Subscription.Status = SubscriptionExpired
+			user.Subscription.CancelAtPeriodEnd = false
+			user.Subscription.record("subscription.expired", now)
+			dbStruct.Users[id] = user
+			expired = append(expired, UserDowngraded{User: user})
+		}
+		if len(expired) == 0 {
+			// nothing to write
+			return errNoChanges
+		}
+		return nil
+	})
+	if errors.Is(err, errNoChanges) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	// the user lost Red when the period ended, this only makes it visible
+	db.publish(expired...)
+	return len(expired), nil
+}
+
+var errNoChanges = errors.New("no changes")
+
+// runSubscriptionSweeper expires lapsed subscriptions until the process
+// exits. Plan checks already treat lapsed users as free in the meantime.
+func runSubscriptionSweeper(db *DB, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		n, err := db.ExpireSubscriptions(time.Now().UTC())
+		if err != nil {
+			log.Printf("Error expiring subscriptions: %v", err)
+		} else if n > 0 {
+			log.Printf("Expired %d Chirpy Red subscriptions", n)
+		}
+		<-ticker.C
+	}
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// subscriptionStep is one Polka event, applied at an offset from the
+// test's start. periodEnd is an offset too, nil when Polka sent none.
+type subscriptionStep struct {
+	event     string
+	at        time.Duration
+	periodEnd *time.Duration
+}
+
+func offset(d time.Duration) *time.Duration {
+	return &d
+}
+
+func TestApplySubscriptionEvent(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+
+	tests := []struct {
+		name          string
+		steps         []subscriptionStep
+		wantStatus    SubscriptionStatus
+		wantPeriodEnd time.Duration
+		wantFlag      bool
+		wantCancel    bool
+		// redAt and notRedAt are checked against hasRed
+		redAt    []time.Duration
+		notRedAt []time.Duration
+	}{
+		{
+			name:          "upgrade without period end",
+			steps:         []subscriptionStep{{event: PolkaUserUpgraded}},
+			wantStatus:    SubscriptionActive,
+			wantPeriodEnd: defaultBillingPeriod,
+			wantFlag:      true,
+			redAt:         []time.Duration{0, defaultBillingPeriod - time.Second},
+			notRedAt:      []time.Duration{defaultBillingPeriod},
+		},
+		{
+			name:          "upgrade with period end",
+			steps:         []subscriptionStep{{event: PolkaUserUpgraded, periodEnd: offset(10 * day)}},
+			wantStatus:    SubscriptionActive,
+			wantPeriodEnd: 10 * day,
+			wantFlag:      true,
+		},
+		{
+			name: "renewal extends from the end of the period",
+			steps: []subscriptionStep{
+				{event: PolkaUserUpgraded},
+				{event: PolkaUserRenewed, at: 20 * day},
+			},
+			wantStatus:    SubscriptionActive,
+			wantPeriodEnd: 2 * defaultBillingPeriod,
+			wantFlag:      true,
+		},
+		{
+			name: "renewal after the period lapsed starts from now",
+			steps: []subscriptionStep{
+				{event: PolkaUserUpgraded},
+				{event: PolkaUserRenewed, at: 40 * day},
+			},
+			wantStatus:    SubscriptionActive,
+			wantPeriodEnd: 40*day + defaultBillingPeriod,
+			wantFlag:      true,
+		},
+		{
+			name: "duplicate upgrade with the same period end",
+			steps: []subscriptionStep{
+				{event: PolkaUserUpgraded, periodEnd: offset(30 * day)},
+				{event: PolkaUserUpgraded, at: time.Minute, periodEnd: offset(30 * day)},
+			},
+			wantStatus:    SubscriptionActive,
+			wantPeriodEnd: 30 * day,
+			wantFlag:      true,
+		},
+		{
+			name: "duplicate renewal with the same period end",
+			steps: []subscriptionStep{
+				{event: PolkaUserUpgraded, periodEnd: offset(30 * day)},
+				{event: PolkaUserRenewed, at: 29 * day, periodEnd: offset(60 * day)},
+				{event: PolkaUserRenewed, at: 29*day + time.Minute, periodEnd: offset(60 * day)},
+			},
+			wantStatus:    SubscriptionActive,
+			wantPeriodEnd: 60 * day,
+			wantFlag:      true,
+		},
+		{
+			name: "upgrade delivered after a renewal",
+			steps: []subscriptionStep{
+				{event: PolkaUserRenewed, at: time.Minute, periodEnd: offset(60 * day)},
+				{event: PolkaUserUpgraded, at: 2 * time.Minute, periodEnd: offset(30 * day)},
+			},
+			wantStatus:    SubscriptionActive,
+			wantPeriodEnd: 60 * day,
+			wantFlag:      true,
+			redAt:         []time.Duration{45 * day},
+		},
+		{
+			name: "older renewal delivered after a newer one",
+			steps: []subscriptionStep{
+				{event: PolkaUserUpgraded, periodEnd: offset(30 * day)},
+				{event: PolkaUserRenewed, at: 60 * day, periodEnd: offset(90 * day)},
+				{event: PolkaUserRenewed, at: 60*day + time.Minute, periodEnd: offset(60 * day)},
+			},
+			wantStatus:    SubscriptionActive,
+			wantPeriodEnd: 90 * day,
+			wantFlag:      true,
+		},
+		{
+			name: "cancel keeps Red until the period ends",
+			steps: []subscriptionStep{
+				{event: PolkaUserUpgraded, periodEnd: offset(30 * day)},
+				{event: PolkaUserCanceled, at: 5 * day},
+			},
+			wantStatus:    SubscriptionCanceled,
+			wantPeriodEnd: 30 * day,
+			wantFlag:      true,
+			wantCancel:    true,
+			redAt:         []time.Duration{29 * day},
+			notRedAt:      []time.Duration{30 * day},
+		},
+		{
+			name: "renewal after a cancel reactivates",
+			steps: []subscriptionStep{
+				{event: PolkaUserUpgraded, periodEnd: offset(30 * day)},
+				{event: PolkaUserCanceled, at: 5 * day},
+				{event: PolkaUserRenewed, at: 6 * day, periodEnd: offset(60 * day)},
+			},
+			wantStatus:    SubscriptionActive,
+			wantPeriodEnd: 60 * day,
+			wantFlag:      true,
+		},
+		{
+			name: "failed payment gets a grace period",
+			steps: []subscriptionStep{
+				{event: PolkaUserUpgraded, periodEnd: offset(30 * day)},
+				{event: PolkaUserPaymentFailed, at: 30 * day},
+			},
+			wantStatus:    SubscriptionPastDue,
+			wantPeriodEnd: 30 * day,
+			wantFlag:      true,
+			redAt:         []time.Duration{30*day + paymentGracePeriod - time.Second},
+			notRedAt:      []time.Duration{30*day + paymentGracePeriod},
+		},
+		{
+			name: "downgrade ends Red immediately",
+			steps: []subscriptionStep{
+				{event: PolkaUserUpgraded, periodEnd: offset(30 * day)},
+				{event: PolkaUserDowngraded, at: 10 * day},
+			},
+			wantStatus:    SubscriptionExpired,
+			wantPeriodEnd: 10 * day,
+			wantFlag:      false,
+			notRedAt:      []time.Duration{10 * day, 20 * day},
+		},
+		{
+			name: "duplicate downgrade",
+			steps: []subscriptionStep{
+				{event: PolkaUserUpgraded, periodEnd: offset(30 * day)},
+				{event: PolkaUserDowngraded, at: 10 * day},
+				{event: PolkaUserDowngraded, at: 10*day + time.Minute},
+			},
+			wantStatus:    SubscriptionExpired,
+			wantPeriodEnd: 10*day + time.Minute,
+			wantFlag:      false,
+		},
+		{
+			name: "downgrade without a subscription",
+			steps: []subscriptionStep{
+				{event: PolkaUserDowngraded},
+			},
+			wantStatus:    SubscriptionExpired,
+			wantPeriodEnd: 0,
+			wantFlag:      false,
+		},
+		{
+			name: "upgrade after a downgrade",
+			steps: []subscriptionStep{
+				{event: PolkaUserUpgraded, periodEnd: offset(30 * day)},
+				{event: PolkaUserDowngraded, at: 10 * day},
+				{event: PolkaUserUpgraded, at: 12 * day, periodEnd: offset(42 * day)},
+			},
+			wantStatus:    SubscriptionActive,
+			wantPeriodEnd: 42 * day,
+			wantFlag:      true,
+			redAt:         []time.Duration{12 * day},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user := User{ID: 1}
+			for i, step := range tt.steps {
+				var periodEnd *time.Time
+				if step.periodEnd != nil {
+					end := start.Add(*step.periodEnd)
+					periodEnd = &end
+				}
+				if !applySubscriptionEvent(&user, step.event, periodEnd, start.Add(step.at)) {
+					t.Fatalf("step %d: %s was not applied", i, step.event)
+				}
+			}
+
+			sub := user.Subscription
+			if sub == nil {
+				t.Fatal("no subscription")
+			}
+			if sub.Status != tt.wantStatus {
+				t.Errorf("got status %s, want %s", sub.Status, tt.wantStatus)
+			}
+			if sub.CurrentPeriodEnd == nil || !sub.CurrentPeriodEnd.Equal(start.Add(tt.wantPeriodEnd)) {
+				t.Errorf("got period end %v, want %v", sub.CurrentPeriodEnd, start.Add(tt.wantPeriodEnd))
+			}
+			if user.IsChirpyRed != tt.wantFlag {
+				t.Errorf("got IsChirpyRed %v, want %v", user.IsChirpyRed, tt.wantFlag)
+			}
+			if sub.CancelAtPeriodEnd != tt.wantCancel {
+				t.Errorf("got CancelAtPeriodEnd %v, want %v", sub.CancelAtPeriodEnd, tt.wantCancel)
+			}
+			if len(sub.History) != len(tt.steps) {
+				t.Errorf("got %d history entries, want %d", len(sub.History), len(tt.steps))
+			}
+			for _, at := range tt.redAt {
+				if !user.hasRed(start.Add(at)) {
+					t.Errorf("no Red at %v", at)
+				}
+			}
+			for _, at := range tt.notRedAt {
+				if user.hasRed(start.Add(at)) {
+					t.Errorf("still Red at %v", at)
+				}
+			}
+		})
+	}
+}
+
+func TestApplySubscriptionEventIgnoresUnknownEvents(t *testing.T) {
+	user := User{ID: 1}
+	if applySubscriptionEvent(&user, "user.deleted", nil, time.Now()) {
+		t.Fatal("unknown event was applied")
+	}
+	if user.Subscription != nil || user.IsChirpyRed {
+		t.Fatalf("user changed: %+v", user)
+	}
+}
+
+func TestApplySubscriptionEventCapsHistory(t *testing.T) {
+	user := User{ID: 1}
+	now := time.Now()
+	for i := 0; i < maxSubscriptionHistory+5; i++ {
+		applySubscriptionEvent(&user, PolkaUserRenewed, nil, now.Add(time.Duration(i)*time.Minute))
+	}
+	history := user.Subscription.History
+	if len(history) != maxSubscriptionHistory {
+		t.Fatalf("got %d history entries, want %d", len(history), maxSubscriptionHistory)
+	}
+	if want := now.Add(time.Duration(maxSubscriptionHistory+4) * time.Minute); !history[len(history)-1].At.Equal(want) {
+		t.Fatalf("last entry at %v, want %v", history[len(history)-1].At, want)
+	}
+}
+
+func TestExpireSubscriptions(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+
+	tests := []struct {
+		name  string
+		steps []subscriptionStep
+		// legacy users were upgraded before subscriptions were tracked
+		legacy      bool
+		sweepAt     time.Duration
+		wantExpired bool
+	}{
+		{
+			name:    "active within the period",
+			steps:   []subscriptionStep{{event: PolkaUserUpgraded, periodEnd: offset(30 * day)}},
+			sweepAt: 29 * day,
+		},
+		{
+			name:        "active past the period",
+			steps:       []subscriptionStep{{event: PolkaUserUpgraded, periodEnd: offset(30 * day)}},
+			sweepAt:     30 * day,
+			wantExpired: true,
+		},
+		{
+			name: "canceled past the period",
+			steps: []subscriptionStep{
+				{event: PolkaUserUpgraded, periodEnd: offset(30 * day)},
+				{event: PolkaUserCanceled, at: day},
+			},
+			sweepAt:     31 * day,
+			wantExpired: true,
+		},
+		{
+			name: "past due within the grace period",
+			steps: []subscriptionStep{
+				{event: PolkaUserUpgraded, periodEnd: offset(30 * day)},
+				{event: PolkaUserPaymentFailed, at: 30 * day},
+			},
+			sweepAt: 30*day + paymentGracePeriod - time.Second,
+		},
+		{
+			name: "past due after the grace period",
+			steps: []subscriptionStep{
+				{event: PolkaUserUpgraded, periodEnd: offset(30 * day)},
+				{event: PolkaUserPaymentFailed, at: 30 * day},
+			},
+			sweepAt:     30*day + paymentGracePeriod,
+			wantExpired: true,
+		},
+		{
+			name: "renewed before the sweep",
+			steps: []subscriptionStep{
+				{event: PolkaUserUpgraded, periodEnd: offset(30 * day)},
+				{event: PolkaUserRenewed, at: 29 * day, periodEnd: offset(60 * day)},
+			},
+			sweepAt: 45 * day,
+		},
+		{
+			name: "already downgraded",
+			steps: []subscriptionStep{
+				{event: PolkaUserUpgraded, periodEnd: offset(30 * day)},
+				{event: PolkaUserDowngraded, at: day},
+			},
+			sweepAt: 45 * day,
+		},
+		{
+			name:    "legacy Red never expires",
+			legacy:  true,
+			sweepAt: 1000 * day,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, err := NewDB(filepath.Join(t.TempDir(), "database.json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			db.Events = NewEventBus()
+			var downgraded []int
+			db.Events.Subscribe(EventUserDowngraded, func(event Event) {
+				downgraded = append(downgraded, event.(UserDowngraded).User.ID)
+			})
+
+			user, err := db.CreateUser("user@example.com", "hash", "user")
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = db.modifyUser(user.ID, func(user *User) error {
+				user.IsChirpyRed = tt.legacy
+				for _, step := range tt.steps {
+					var periodEnd *time.Time
+					if step.periodEnd != nil {
+						end := start.Add(*step.periodEnd)
+						periodEnd = &end
+					}
+					applySubscriptionEvent(user, step.event, periodEnd, start.Add(step.at))
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			before, err := db.GetUserByID(user.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			n, err := db.ExpireSubscriptions(start.Add(tt.sweepAt))
+			if err != nil {
+				t.Fatal(err)
+			}
+			after, err := db.GetUserByID(user.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !tt.wantExpired {
+				if n != 0 || len(downgraded) != 0 {
+					t.Fatalf("expired %d users, published %d downgrades, want none", n, len(downgraded))
+				}
+				if after.IsChirpyRed != before.IsChirpyRed {
+					t.Fatalf("IsChirpyRed changed from %v to %v", before.IsChirpyRed, after.IsChirpyRed)
+				}
+				return
+			}
+			if n != 1 || len(downgraded) != 1 || downgraded[0] != user.ID {
+				t.Fatalf("expired %d users, published downgrades for %v, want user %d", n, downgraded, user.ID)
+			}
+			if after.IsChirpyRed || after.Subscription.Status != SubscriptionExpired || after.Subscription.CancelAtPeriodEnd {
+				t.Fatalf("got red=%v status=%s cancel=%v after expiry", after.IsChirpyRed, after.Subscription.Status, after.Subscription.CancelAtPeriodEnd)
+			}
+			history := after.Subscription.History
+			if last := history[len(history)-1]; last.Event != "subscription.expired" || !last.At.Equal(start.Add(tt.sweepAt)) {
+				t.Fatalf("last history entry %+v", last)
+			}
+
+			// a second sweep has nothing left to do
+			if n, err := db.ExpireSubscriptions(start.Add(tt.sweepAt + day)); err != nil || n != 0 {
+				t.Fatalf("second sweep expired %d users, err %v", n, err)
+			}
+		})
+	}
+}
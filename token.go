@@ -1,7 +1,10 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"net/http"
+	"strconv"
 	"time"
 )
 
@@ -50,12 +53,34 @@ func (cfg *apiConfig) handlerRefreshToken(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	// Generate a new access token
-	newAccessToken, err := RefreshToken(refreshToken, cfg.jwtSecret)
+	userIDString, err := validateTokenOfType(refreshToken, cfg.jwtSecret, TokenTypeRefresh)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Failed to refresh token")
+		return
+	}
+	userID, err := strconv.Atoi(userIDString)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Failed to refresh token")
+		return
+	}
+
+	// Look the user up so the new token carries their current role
+	user, err := cfg.database.GetUserByID(userID)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Failed to refresh token")
 		return
 	}
+	if user.Suspended {
+		respondWithAuthError(w, ErrUserSuspended)
+		return
+	}
+
+	// Generate a new access token
+	newAccessToken, err := MakeAccessToken(user, cfg.jwtSecret, time.Hour)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to refresh token")
+		return
+	}
 
 	// Respond with the new access token
 	respondWithJSON(w, http.StatusOK, map[string]interface{}{
@@ -63,17 +88,27 @@ func (cfg *apiConfig) handlerRefreshToken(w http.ResponseWriter, r *http.Request
 	})
 }
 
-func (db *DB) RevokeToken(tokenString string) error {
-	dbStruct, err := db.loadDB()
-	if err != nil {
-		return err
-	}
+// refreshTokenHash identifies a token in events and logs without
+// revealing it
+func refreshTokenHash(tokenString string) string {
+	sum := sha256.Sum256([]byte(tokenString))
+	return hex.EncodeToString(sum[:])
+}
 
-	dbStruct.Revocations[tokenString] = Revocation{
+func (db *DB) RevokeToken(tokenString string) error {
+	revocation := Revocation{
 		Token:     tokenString,
 		RevokedAt: time.Now().UTC(),
 	}
-	return db.writeDB(dbStruct)
+	err := db.update(func(dbStruct *DBStructure) error {
+		dbStruct.Revocations[tokenString] = revocation
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	db.publish(TokenRevoked{TokenHash: refreshTokenHash(revocation.Token), RevokedAt: revocation.RevokedAt})
+	return nil
 }
 
 func (db *DB) isTokenRevoked(tokenString string) (bool, error) {
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	totpIssuer        = "Chirpy"
+	totpPeriod        = 30 // seconds per step, RFC 6238 default
+	totpDigits        = 6
+	totpSkew          = 1 // steps accepted either side of now
+	totpSecretBytes   = 20
+	recoveryCodeCount = 10
+	mfaChallengeTTL   = 5 * time.Minute
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// ErrInvalidTOTPCode -
+var ErrInvalidTOTPCode = errors.New("invalid two-factor code")
+
+// generateTOTPSecret returns a random base32 encoded shared secret
+func generateTOTPSecret() (string, error) {
+	secret := make([]byte, totpSecretBytes)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(secret), nil
+}
+
+// totpProvisioningURI builds the otpauth URI authenticator apps scan
+func totpProvisioningURI(secret, accountName string) string {
+	label := url.PathEscape(totpIssuer + ":" + accountName)
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", totpIssuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", strconv.Itoa(totpDigits))
+	params.Set("period", strconv.Itoa(totpPeriod))
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// totpCode computes the HOTP value (RFC 4226) for the given time step
+func totpCode(secret string, step int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod), nil
+}
+
+// validateTOTP checks a code against the secret and returns the time step
+// it matched. Steps at or before lastStep are rejected so a code can only
+// be used once.
+func validateTOTP(secret, code string, lastStep int64) (int64, error) {
+	code = strings.TrimSpace(code)
+	if len(code) != totpDigits {
+		return 0, ErrInvalidTOTPCode
+	}
+
+	current := time.Now().UTC().Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		expected, err := totpCode(secret, step)
+		if err != nil {
+			return 0, err
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, nil
+		}
+	}
+	return 0, ErrInvalidTOTPCode
+}
+
+// generateRecoveryCodes returns plain recovery codes and their hashes
+func generateRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		raw := make([]byte, 5)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, nil, err
+		}
+		encoded := strings.ToLower(totpEncoding.EncodeToString(raw))
+		code := encoded[:4] + "-" + encoded[4:]
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+// hashRecoveryCode normalises and hashes a recovery code for storage.
+// The codes are random, so a fast hash is enough.
+func hashRecoveryCode(code string) string {
+	normalised := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	sum := sha256.Sum256([]byte(normalised))
+	return hex.EncodeToString(sum[:])
+}
+
+// SetTOTPSecret stores a pending secret; 2FA stays off until verified
+func (db *DB) SetTOTPSecret(userID int, secret string) error {
+	_, err := db.modifyUser(userID, func(user *User) error {
+		if user.TOTPEnabled {
+			return fmt.Errorf("two-factor authentication already enabled: %w", ErrConflict)
+		}
+		user.TOTPSecret = secret
+		user.TOTPLastStep = 0
+		return nil
+	})
+	return err
+}
+
+// EnableTOTP turns 2FA on after a code has been verified
+func (db *DB) EnableTOTP(userID int, step int64, recoveryHashes []string) error {
+	_, err := db.modifyUser(userID, func(user *User) error {
+		user.TOTPEnabled = true
+		user.TOTPLastStep = step
+		user.RecoveryCodes = recoveryHashes
+		return nil
+	})
+	return err
+}
+
+// DisableTOTP removes the secret and recovery codes
+func (db *DB) DisableTOTP(userID int) error {
+	_, err := db.modifyUser(userID, func(user *User) error {
+		user.TOTPEnabled = false
+		user.TOTPSecret = ""
+		user.TOTPLastStep = 0
+		user.RecoveryCodes = nil
+		return nil
+	})
+	return err
+}
+
+// VerifySecondFactor accepts either a current TOTP code or an unused
+// recovery code. Used steps and recovery codes are consumed.
+func (db *DB) VerifySecondFactor(userID int, code, recoveryCode string) error {
+	_, err := db.modifyUser(userID, func(user *User) error {
+		if !user.TOTPEnabled {
+			return fmt.Errorf("two-factor authentication not enabled: %w", ErrInvalidInput)
+		}
+		if recoveryCode != "" {
+			hashed := hashRecoveryCode(recoveryCode)
+			for i, stored := range user.RecoveryCodes {
+				if subtle.ConstantTimeCompare([]byte(stored), []byte(hashed)) == 1 {
+					user.RecoveryCodes = append(user.RecoveryCodes[:i], user.RecoveryCodes[i+1:]...)
+					return nil
+				}
+			}
+			return ErrInvalidTOTPCode
+		}
+		step, err := validateTOTP(user.TOTPSecret, code, user.TOTPLastStep)
+		if err != nil {
+			return err
+		}
+		user.TOTPLastStep = step
+		return nil
+	})
+	return err
+}
+
+// respondWithMFAChallenge answers a correct password login for a user with
+// 2FA enabled. The challenge token can only be exchanged at /api/login/mfa.
+func (cfg *apiConfig) respondWithMFAChallenge(w http.ResponseWriter, user User, expiresInSeconds int) {
+	challenge, err := MakeJWT(user.ID, cfg.jwtSecret, mfaChallengeTTL, TokenTypeMFA)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to sign MFA challenge")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"mfa_required":       true,
+		"mfa_token":          challenge,
+		"expires_in_seconds": expiresInSeconds,
+	})
+}
+
+func (cfg *apiConfig) handlerLoginMFA(w http.ResponseWriter, r *http.Request) {
+	var mfaRequest struct {
+		MFAToken         string `json:"mfa_token"`
+		Code             string `json:"code"`
+		RecoveryCode     string `json:"recovery_code"`
+		ExpiresInSeconds int    `json:"expires_in_seconds,omitempty"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&mfaRequest); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	userIDString, err := validateTokenOfType(mfaRequest.MFAToken, cfg.jwtSecret, TokenTypeMFA)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Invalid or expired MFA token")
+		return
+	}
+	userID, err := strconv.Atoi(userIDString)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Invalid MFA token")
+		return
+	}
+
+	user, err := cfg.database.GetUserByID(userID)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Invalid MFA token")
+		return
+	}
+	if user.Suspended {
+		respondWithAuthError(w, ErrUserSuspended)
+		return
+	}
+
+	// codes are short, so guesses count towards the same lockout as passwords
+	attemptKeys := loginAttemptKeys(user.Email, clientIP(r))
+	if !cfg.ensureLoginAllowed(w, attemptKeys) {
+		return
+	}
+
+	if err := cfg.database.VerifySecondFactor(userID, mfaRequest.Code, mfaRequest.RecoveryCode); err != nil {
+		cfg.respondWithLoginFailure(w, attemptKeys, "Invalid two-factor code")
+		return
+	}
+
+	if err := cfg.database.ClearLoginAttempts(attemptKeys[:1]); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to reset login attempts")
+		return
+	}
+
+	cfg.respondWithLoginTokens(w, user, mfaRequest.ExpiresInSeconds)
+}
+
+func (cfg *apiConfig) handlerTOTPEnroll(w http.ResponseWriter, r *http.Request) {
+	userID, err := cfg.getAuthenticatedUserID(r)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	user, err := cfg.database.GetUserByID(userID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "User not found")
+		return
+	}
+	if user.TOTPEnabled {
+		respondWithError(w, http.StatusConflict, "Two-factor authentication already enabled")
+		return
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to generate secret")
+		return
+	}
+	if err := cfg.database.SetTOTPSecret(userID, secret); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to store secret")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"secret":           secret,
+		"provisioning_uri": totpProvisioningURI(secret, user.Email),
+	})
+}
+
+func (cfg *apiConfig) handlerTOTPVerify(w http.ResponseWriter, r *http.Request) {
+	userID, err := cfg.getAuthenticatedUserID(r)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	var verifyRequest struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&verifyRequest); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	user, err := cfg.database.GetUserByID(userID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "User not found")
+		return
+	}
+	if user.TOTPEnabled {
+		respondWithError(w, http.StatusConflict, "Two-factor authentication already enabled")
+		return
+	}
+	if user.TOTPSecret == "" {
+		respondWithError(w, http.StatusBadRequest, "Start enrollment first")
+		return
+	}
+
+	// a stolen access token mustn't allow guessing codes either
+	attemptKeys := loginAttemptKeys(user.Email, clientIP(r))
+	if !cfg.ensureLoginAllowed(w, attemptKeys) {
+		return
+	}
+	step, err := validateTOTP(user.TOTPSecret, verifyRequest.Code, user.TOTPLastStep)
+	if err != nil {
+		cfg.respondWithLoginFailure(w, attemptKeys, "Invalid two-factor code")
+		return
+	}
+	if err := cfg.database.ClearLoginAttempts(attemptKeys[:1]); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to reset login attempts")
+		return
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to generate recovery codes")
+		return
+	}
+	if err := cfg.database.EnableTOTP(userID, step, hashes); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to enable two-factor authentication")
+		return
+	}
+
+	// the plain codes are only ever shown here
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"totp_enabled":   true,
+		"recovery_codes": codes,
+	})
+}
+
+func (cfg *apiConfig) handlerTOTPDisable(w http.ResponseWriter, r *http.Request) {
+	userID, err := cfg.getAuthenticatedUserID(r)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	var disableRequest struct {
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&disableRequest); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	user, err := cfg.database.GetUserByID(userID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "User not found")
+		return
+	}
+	// otherwise a stolen access token could try every code and turn 2FA off
+	attemptKeys := loginAttemptKeys(user.Email, clientIP(r))
+	if !cfg.ensureLoginAllowed(w, attemptKeys) {
+		return
+	}
+	if err := cfg.database.VerifySecondFactor(userID, disableRequest.Code, disableRequest.RecoveryCode); err != nil {
+		cfg.respondWithLoginFailure(w, attemptKeys, "Invalid two-factor code")
+		return
+	}
+	if err := cfg.database.ClearLoginAttempts(attemptKeys[:1]); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to reset login attempts")
+		return
+	}
+	if err := cfg.database.DisableTOTP(userID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to disable two-factor authentication")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"totp_enabled": false,
+	})
+}
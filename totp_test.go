@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// rfcTOTPSecret is the ASCII key "12345678901234567890" used by the
+// RFC 4226 and RFC 6238 test vectors, base32 encoded
+const rfcTOTPSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCodeRFC4226(t *testing.T) {
+	// RFC 4226 appendix D, counters 0-9
+	want := []string{"755224", "287082", "359152", "969429", "338314", "254676", "287922", "162583", "399871", "520489"}
+	for counter, code := range want {
+		got, err := totpCode(rfcTOTPSecret, int64(counter))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != code {
+			t.Errorf("counter %d: got %s, want %s", counter, got, code)
+		}
+	}
+}
+
+func TestTOTPCodeRFC6238(t *testing.T) {
+	// RFC 6238 appendix B, SHA1 rows, last 6 of the 8 digits
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		got, err := totpCode(rfcTOTPSecret, tt.unix/totpPeriod)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.code {
+			t.Errorf("T=%d: got %s, want %s", tt.unix, got, tt.code)
+		}
+	}
+}
+
+func TestTOTPCodeLowercaseSecret(t *testing.T) {
+	got, err := totpCode("gezdgnbvgy3tqojqgezdgnbvgy3tqojq", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "287082" {
+		t.Fatalf("got %s", got)
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	current := time.Now().UTC().Unix() / totpPeriod
+	code, err := totpCode(secret, current)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	step, err := validateTOTP(secret, " "+code+" ", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if step < current-totpSkew || step > current+totpSkew {
+		t.Fatalf("matched step %d, now is %d", step, current)
+	}
+
+	// the same code can't be used twice
+	if _, err := validateTOTP(secret, code, step); !errors.Is(err, ErrInvalidTOTPCode) {
+		t.Fatalf("reused code: %v", err)
+	}
+
+	old, err := totpCode(secret, current-totpSkew-2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := validateTOTP(secret, old, 0); !errors.Is(err, ErrInvalidTOTPCode) {
+		t.Fatalf("expired code: %v", err)
+	}
+
+	if _, err := validateTOTP(secret, "12345", 0); !errors.Is(err, ErrInvalidTOTPCode) {
+		t.Fatalf("short code: %v", err)
+	}
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"strconv"
 	"strings"
@@ -13,10 +15,28 @@ import (
 )
 
 type User struct {
-	Password    string `json:"password,omitempty"`
-	Email       string `json:"email"`
-	ID          int    `json:"id"`
-	IsChirpyRed bool   `json:"is_chirpy_red"`
+	Password        string    `json:"password,omitempty"`
+	Email           string    `json:"email"`
+	Handle          string    `json:"handle,omitempty"`
+	ID              int       `json:"id"`
+	IsChirpyRed     bool      `json:"is_chirpy_red"`
+	EmailVerified   bool      `json:"email_verified"`
+	Role            Role      `json:"role,omitempty"`
+	Suspended       bool      `json:"suspended,omitempty"`
+	SuspendedReason string    `json:"suspended_reason,omitempty"`
+	DisplayName     string    `json:"display_name,omitempty"`
+	Bio             string    `json:"bio,omitempty"`
+	AvatarURL       string    `json:"avatar_url,omitempty"`
+	CreatedAt       time.Time `json:"created_at"`
+	TOTPSecret      string    `json:"totp_secret,omitempty"`
+	TOTPEnabled     bool      `json:"totp_enabled,omitempty"`
+	TOTPLastStep    int64     `json:"totp_last_step,omitempty"`
+	RecoveryCodes   []string  `json:"recovery_codes,omitempty"`
+	// PasswordResetAt is the last password reset; reset tokens issued
+	// before it no longer work
+	PasswordResetAt *time.Time `json:"password_reset_at,omitempty"`
+	// Subscription is nil until Polka first tells us about the user
+	Subscription *Subscription `json:"subscription,omitempty"`
 }
 
 func (cfg *apiConfig) handlerLogin(w http.ResponseWriter, r *http.Request) {
@@ -31,38 +51,70 @@ func (cfg *apiConfig) handlerLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := cfg.database.GetUserByEmail(loginRequest.Email)
+	attemptKeys := loginAttemptKeys(loginRequest.Email, clientIP(r))
+	retryAfter, failures, err := cfg.database.CheckLoginAllowed(attemptKeys)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid email or password")
+		respondWithError(w, http.StatusInternalServerError, "Failed to check login attempts")
+		return
+	}
+	if retryAfter > 0 {
+		respondLockedOut(w, retryAfter)
 		return
 	}
+	// slow down repeated guessing before doing any password work
+	time.Sleep(loginDelay(failures))
 
-	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(loginRequest.Password))
+	user, err := cfg.database.GetUserByEmail(loginRequest.Email)
+	if err == nil {
+		err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(loginRequest.Password))
+	}
 	if err != nil {
+		lockedFor, recordErr := cfg.database.RecordLoginFailure(attemptKeys)
+		if recordErr != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to record login attempt")
+			return
+		}
+		if lockedFor > 0 {
+			respondLockedOut(w, lockedFor)
+			return
+		}
 		respondWithError(w, http.StatusUnauthorized, "Invalid email or password")
 		return
 	}
 
+	// only the account's counter is cleared; the IP keeps its history
+	if err := cfg.database.ClearLoginAttempts(attemptKeys[:1]); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to reset login attempts")
+		return
+	}
+
+	if user.Suspended {
+		respondWithAuthError(w, ErrUserSuspended)
+		return
+	}
+
+	if user.TOTPEnabled {
+		cfg.respondWithMFAChallenge(w, user, loginRequest.ExpiresInSeconds)
+		return
+	}
+
+	cfg.respondWithLoginTokens(w, user, loginRequest.ExpiresInSeconds)
+}
+
+// respondWithLoginTokens issues an access and refresh token pair for a
+// user that has fully authenticated
+func (cfg *apiConfig) respondWithLoginTokens(w http.ResponseWriter, user User, expiresInSeconds int) {
 	expiresIn := 24 * time.Hour // Default to 24 hours
-	if loginRequest.ExpiresInSeconds > 0 {
-		requestedExpiresIn := time.Duration(loginRequest.ExpiresInSeconds) * time.Second
+	if expiresInSeconds > 0 {
+		requestedExpiresIn := time.Duration(expiresInSeconds) * time.Second
 		if requestedExpiresIn > expiresIn {
 			requestedExpiresIn = expiresIn // Cap at 24 hours
 		}
 		expiresIn = requestedExpiresIn
 	}
 
-	// Prepare claims
-	accessClaims := jwt.RegisteredClaims{
-		Issuer:    "chirpy-access",
-		IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
-		ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(expiresIn)),
-		Subject:   strconv.Itoa(user.ID),
-	}
-
-	// Create token
-	accessToken := jwt.NewWithClaims(jwt.SigningMethodHS256, accessClaims)
-	tokenString, err := accessToken.SignedString([]byte(cfg.jwtSecret))
+	// Create token, the role goes in the claims
+	tokenString, err := MakeAccessToken(user, cfg.jwtSecret, expiresIn)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Failed to sign access token")
 		return
@@ -79,36 +131,67 @@ func (cfg *apiConfig) handlerLogin(w http.ResponseWriter, r *http.Request) {
 	refreshTokenString, err := refreshToken.SignedString([]byte(cfg.jwtSecret))
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Failed to sign refresh token")
+		return
 	}
 
 	// Respond with token and user info
 	respondWithJSON(w, http.StatusOK, map[string]interface{}{
-		"id":            user.ID,
-		"email":         user.Email,
-		"is_chirpy_red": user.IsChirpyRed,
-		"token":         tokenString,
-		"refresh_token": refreshTokenString,
+		"id":             user.ID,
+		"email":          user.Email,
+		"is_chirpy_red":  user.Plan() == PlanRed,
+		"email_verified": user.EmailVerified,
+		"role":           user.EffectiveRole(),
+		"token":          tokenString,
+		"refresh_token":  refreshTokenString,
 	})
-
 }
 
 func (cfg *apiConfig) handlerCreateUser(w http.ResponseWriter, r *http.Request) {
 	var newUserRequest struct {
 		Email    string `json:"email"`
 		Password string `json:"password"`
+		Handle   string `json:"handle"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&newUserRequest); err != nil {
 		respondWithError(w, http.StatusBadRequest, "Invalid request body")
 		return
 	}
 
-	newUser, err := cfg.database.CreateUser(newUserRequest.Email, newUserRequest.Password)
+	fieldErrors := FieldErrors{}
+	email, err := normalizeEmail(newUserRequest.Email)
+	if err != nil {
+		fieldErrors["email"] = err.Error()
+	}
+	if msg := cfg.passwordPolicy.Validate(newUserRequest.Password); msg != "" {
+		fieldErrors["password"] = msg
+	}
+	var handle string
+	if newUserRequest.Handle != "" {
+		handle, err = normalizeHandle(newUserRequest.Handle)
+		if err != nil {
+			fieldErrors["handle"] = err.Error()
+		}
+	}
+	if len(fieldErrors) > 0 {
+		respondWithValidationErrors(w, fieldErrors)
+		return
+	}
+
+	newUser, err := cfg.database.CreateUser(email, newUserRequest.Password, handle)
+	if errors.Is(err, ErrConflict) {
+		respondWithUserConflict(w, err)
+		return
+	}
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Failed to create user")
 		return
 	}
 
-	respondWithJSON(w, http.StatusCreated, User{ID: newUser.ID, Email: newUser.Email})
+	if err := cfg.sendVerificationEmail(newUser); err != nil {
+		log.Printf("Error sending verification email: %v", err)
+	}
+
+	respondWithJSON(w, http.StatusCreated, User{ID: newUser.ID, Email: newUser.Email, Handle: newUser.Handle, CreatedAt: newUser.CreatedAt})
 
 }
 
@@ -118,12 +201,13 @@ func (db *DB) GetUserByEmail(email string) (User, error) {
 		return User{}, err
 	}
 
+	email = strings.TrimSpace(email)
 	for _, user := range dbStruct.Users {
-		if user.Email == email {
+		if strings.EqualFold(user.Email, email) {
 			return user, nil
 		}
 	}
-	return User{}, fmt.Errorf("user not found")
+	return User{}, fmt.Errorf("user %w", ErrNotFound)
 }
 
 func (cfg *apiConfig) handleUpdateUsers(w http.ResponseWriter, r *http.Request) {
@@ -159,10 +243,19 @@ func (cfg *apiConfig) handleUpdateUsers(w http.ResponseWriter, r *http.Request)
 		respondWithError(w, http.StatusUnauthorized, "Error parsing User ID")
 		return
 	}
+	if !cfg.ensureActiveUser(w, userID) {
+		return
+	}
 
+	// pointers tell an omitted field apart from an empty one;
+	// omitted fields are left unchanged
 	var updateReq struct {
-		Email    string `json:"email"`
-		Password string `json:"password"`
+		Email       *string `json:"email"`
+		Password    *string `json:"password"`
+		Handle      *string `json:"handle"`
+		DisplayName *string `json:"display_name"`
+		Bio         *string `json:"bio"`
+		AvatarURL   *string `json:"avatar_url"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&updateReq); err != nil {
@@ -170,9 +263,35 @@ func (cfg *apiConfig) handleUpdateUsers(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	fieldErrors := FieldErrors{}
+	var email string
+	if updateReq.Email != nil {
+		email, err = normalizeEmail(*updateReq.Email)
+		if err != nil {
+			fieldErrors["email"] = err.Error()
+		}
+	}
+	if updateReq.Password != nil {
+		if msg := cfg.passwordPolicy.Validate(*updateReq.Password); msg != "" {
+			fieldErrors["password"] = msg
+		}
+	}
+	if updateReq.Handle != nil {
+		handle, err := normalizeHandle(*updateReq.Handle)
+		if err != nil {
+			fieldErrors["handle"] = err.Error()
+		}
+		updateReq.Handle = &handle
+	}
+	validateProfileFields(updateReq.DisplayName, updateReq.Bio, updateReq.AvatarURL, fieldErrors)
+	if len(fieldErrors) > 0 {
+		respondWithValidationErrors(w, fieldErrors)
+		return
+	}
+
 	var hashedPassword string
-	if updateReq.Password != "" {
-		bytes, err := bcrypt.GenerateFromPassword([]byte(updateReq.Password), bcrypt.DefaultCost)
+	if updateReq.Password != nil {
+		bytes, err := bcrypt.GenerateFromPassword([]byte(*updateReq.Password), bcrypt.DefaultCost)
 		if err != nil {
 			respondWithError(w, http.StatusInternalServerError, "Error hashing password")
 			return
@@ -180,14 +299,45 @@ func (cfg *apiConfig) handleUpdateUsers(w http.ResponseWriter, r *http.Request)
 		hashedPassword = string(bytes)
 	}
 
-	err = cfg.database.UpdateUser(userID, updateReq.Email, hashedPassword)
+	previous, err := cfg.database.GetUserByID(userID)
+	if err != nil {
+		respondWithDBError(w, err, "User not found")
+		return
+	}
+
+	user, err := cfg.database.UpdateUser(userID, UserUpdate{
+		Email:          email,
+		HashedPassword: hashedPassword,
+		Handle:         updateReq.Handle,
+		DisplayName:    updateReq.DisplayName,
+		Bio:            updateReq.Bio,
+		AvatarURL:      updateReq.AvatarURL,
+	})
+	if errors.Is(err, ErrConflict) {
+		respondWithUserConflict(w, err)
+		return
+	}
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Failed to update user")
+		respondWithDBError(w, err, "Failed to update user")
 		return
 	}
+	if user.AvatarURL != previous.AvatarURL {
+		deleteUnusedBlobs(cfg.database, cfg.blobStore, []string{mediaKey(previous.AvatarURL)})
+	}
 
 	respondWithJSON(w, http.StatusOK, map[string]interface{}{
-		"id":    userID,
-		"email": updateReq.Email,
+		"id":             user.ID,
+		"email":          user.Email,
+		"email_verified": user.EmailVerified,
+		"handle":         user.Handle,
+		"display_name":   user.DisplayName,
+		"bio":            user.Bio,
+		"avatar_url":     user.AvatarURL,
+	})
+}
+
+func respondWithEmailConflict(w http.ResponseWriter) {
+	respondWithProblem(w, http.StatusConflict, "email_taken", "Email already in use", FieldErrors{
+		"email": "is already in use",
 	})
 }
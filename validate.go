@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
 	"strconv"
@@ -27,6 +28,9 @@ func (cfg *apiConfig) handlerCreateChirp(w http.ResponseWriter, r *http.Request)
 		respondWithError(w, http.StatusUnauthorized, "Unauthorized: Invalid token")
 		return
 	}
+	if !cfg.ensureActiveUser(w, userID) {
+		return
+	}
 
 	var newChirp struct {
 		Body string `json:"body"`
@@ -36,9 +40,14 @@ func (cfg *apiConfig) handlerCreateChirp(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	createdChirp, err := cfg.database.CreateChirp(newChirp.Body, userID)
+	_, limits, err := cfg.entitlementsFor(userID)
+	if err != nil {
+		respondWithDBError(w, err, "User not found")
+		return
+	}
+	createdChirp, err := cfg.database.CreateChirp(newChirp.Body, userID, limits)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Could not create chirp")
+		respondWithChirpError(w, err, limits)
 		return
 	}
 
@@ -47,6 +56,7 @@ func (cfg *apiConfig) handlerCreateChirp(w http.ResponseWriter, r *http.Request)
 
 func (cfg *apiConfig) handlerGetChirps(w http.ResponseWriter, r *http.Request) {
 	authorIDParam := r.URL.Query().Get("author_id")
+	authorParam := r.URL.Query().Get("author")
 	sort := r.URL.Query().Get("sort")
 
 	// Default to ascending sort if not specified or if an invalid value is provided
@@ -62,6 +72,22 @@ func (cfg *apiConfig) handlerGetChirps(w http.ResponseWriter, r *http.Request) {
 			respondWithError(w, http.StatusBadRequest, "Invalid author ID")
 			return
 		}
+	} else if authorParam != "" {
+		// author=@handle, old handles still resolve during the grace period
+		if !strings.HasPrefix(authorParam, "@") {
+			respondWithError(w, http.StatusBadRequest, "Author must be an @handle")
+			return
+		}
+		author, _, err := cfg.database.ResolveHandle(authorParam)
+		if errors.Is(err, ErrNotFound) {
+			respondWithJSON(w, http.StatusOK, []Chirp{})
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Could not retrieve chirps")
+			return
+		}
+		authorID = author.ID
 	}
 
 	// If authorIDParam is empty, pass a zero value for authorID.
@@ -84,6 +110,10 @@ func (cfg *apiConfig) handlerGetChirpsByID(w http.ResponseWriter, r *http.Reques
 
 	chirp, err := cfg.database.GetChirpByID(chirpID)
 	if err != nil {
+		respondWithDBError(w, err, "Chirp not found")
+		return
+	}
+	if chirp.Hidden {
 		respondWithError(w, http.StatusNotFound, "Chirp not found")
 		return
 	}
@@ -126,6 +156,9 @@ func (cfg *apiConfig) handlerChirpsValidate(w http.ResponseWriter, r *http.Reque
 		respondWithError(w, http.StatusBadRequest, "Invalid user ID")
 		return
 	}
+	if !cfg.ensureActiveUser(w, userID) {
+		return
+	}
 
 	type parameters struct {
 		Body string `json:"body"`
@@ -143,17 +176,22 @@ func (cfg *apiConfig) handlerChirpsValidate(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	const maxChirpLength = 140
-	if len(params.Body) > maxChirpLength {
+	// the limit depends on the user's plan
+	_, limits, err := cfg.entitlementsFor(userID)
+	if err != nil {
+		respondWithDBError(w, err, "User not found")
+		return
+	}
+	if limits.checkChirpLength(params.Body) != nil {
 		respondWithError(w, http.StatusBadRequest, "Chirp is too long")
 		return
 	}
 
 	cleanedContent := cleanChirpContent(params.Body)
 
-	chirp, err := cfg.database.CreateChirp(cleanedContent, userID)
+	chirp, err := cfg.database.CreateChirp(cleanedContent, userID, limits)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Failed to save chirp")
+		respondWithChirpError(w, err, limits)
 		return
 	}
 
@@ -164,15 +202,7 @@ func (cfg *apiConfig) handlerChirpsValidate(w http.ResponseWriter, r *http.Reque
 }
 
 func respondWithError(w http.ResponseWriter, code int, msg string) {
-	if code > 499 {
-		log.Printf("Responding with 5XX error: %s", msg)
-	}
-	type errorResponse struct {
-		Error string `json:"error"`
-	}
-	respondWithJSON(w, code, errorResponse{
-		Error: msg,
-	})
+	respondWithProblem(w, code, "", msg, nil)
 }
 
 func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
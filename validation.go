@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/mail"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const maxEmailLength = 254
+
+// FieldErrors maps a request field to what is wrong with it
+type FieldErrors map[string]string
+
+// passwordPolicy describes what a password has to look like
+type passwordPolicy struct {
+	MinLength        int
+	MaxLength        int
+	RequireDigit     bool
+	RequireMixedCase bool
+	RequireSymbol    bool
+}
+
+// defaultPasswordPolicy - bcrypt only looks at the first 72 bytes.
+// MinLength counts characters, MaxLength bytes.
+var defaultPasswordPolicy = passwordPolicy{
+	MinLength: 8,
+	MaxLength: 72,
+}
+
+// passwordPolicyFromEnv reads PASSWORD_* overrides on top of the defaults
+func passwordPolicyFromEnv() (passwordPolicy, error) {
+	policy := defaultPasswordPolicy
+
+	if v := os.Getenv("PASSWORD_MIN_LENGTH"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > policy.MaxLength {
+			return passwordPolicy{}, fmt.Errorf("PASSWORD_MIN_LENGTH must be between 1 and %d", policy.MaxLength)
+		}
+		policy.MinLength = n
+	}
+	for name, field := range map[string]*bool{
+		"PASSWORD_REQUIRE_DIGIT":      &policy.RequireDigit,
+		"PASSWORD_REQUIRE_MIXED_CASE": &policy.RequireMixedCase,
+		"PASSWORD_REQUIRE_SYMBOL":     &policy.RequireSymbol,
+	} {
+		if v := os.Getenv(name); v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return passwordPolicy{}, fmt.Errorf("%s must be true or false", name)
+			}
+			*field = b
+		}
+	}
+	return policy, nil
+}
+
+// Validate returns a description of the first rule the password breaks
+func (p passwordPolicy) Validate(password string) string {
+	// the minimum is what a person types, the maximum is what bcrypt reads
+	if utf8.RuneCountInString(password) < p.MinLength {
+		return fmt.Sprintf("must be at least %d characters", p.MinLength)
+	}
+	if len(password) > p.MaxLength {
+		return fmt.Sprintf("must be at most %d bytes", p.MaxLength)
+	}
+
+	var hasDigit, hasUpper, hasLower, hasSymbol bool
+	for _, c := range password {
+		switch {
+		case unicode.IsDigit(c):
+			hasDigit = true
+		case unicode.IsUpper(c):
+			hasUpper = true
+		case unicode.IsLower(c):
+			hasLower = true
+		case unicode.IsPunct(c) || unicode.IsSymbol(c):
+			hasSymbol = true
+		}
+	}
+	if p.RequireDigit && !hasDigit {
+		return "must contain a digit"
+	}
+	if p.RequireMixedCase && !(hasUpper && hasLower) {
+		return "must contain upper and lower case letters"
+	}
+	if p.RequireSymbol && !hasSymbol {
+		return "must contain a symbol"
+	}
+	return ""
+}
+
+// normalizeEmail parses a bare RFC 5322 address and lower-cases it so
+// that uniqueness checks are case-insensitive
+func normalizeEmail(email string) (string, error) {
+	email = strings.TrimSpace(email)
+	if email == "" {
+		return "", fmt.Errorf("is required")
+	}
+	if len(email) > maxEmailLength {
+		return "", fmt.Errorf("must be at most %d characters", maxEmailLength)
+	}
+
+	addr, err := mail.ParseAddress(email)
+	// reject display names and angle brackets, only the address is accepted
+	if err != nil || addr.Name != "" || addr.Address != email {
+		return "", fmt.Errorf("is not a valid email address")
+	}
+	at := strings.LastIndex(addr.Address, "@")
+	if at < 1 || !strings.Contains(addr.Address[at+1:], ".") {
+		return "", fmt.Errorf("is not a valid email address")
+	}
+	return strings.ToLower(addr.Address), nil
+}
+
+func respondWithValidationErrors(w http.ResponseWriter, fieldErrors FieldErrors) {
+	respondWithProblem(w, http.StatusUnprocessableEntity, "validation_failed", "Validation failed", fieldErrors)
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	emailVerificationTTL = 48 * time.Hour
+	passwordResetTTL     = time.Hour
+)
+
+// ErrTokenUsed -
+var ErrTokenUsed = errors.New("token already used")
+
+// actionClaims are carried by single-use email tokens. The email is
+// included so a token stops working once the address changes.
+type actionClaims struct {
+	Email string `json:"email"`
+	jwt.RegisteredClaims
+}
+
+// makeActionToken signs a single-use token for an emailed link
+func makeActionToken(user User, tokenSecret string, expiresIn time.Duration, tokenType TokenType) (string, error) {
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", err
+	}
+
+	now := time.Now().UTC()
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, actionClaims{
+		Email: user.Email,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    string(tokenType),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(expiresIn)),
+			Subject:   strconv.Itoa(user.ID),
+			ID:        hex.EncodeToString(jti),
+		},
+	})
+	return token.SignedString([]byte(tokenSecret))
+}
+
+// parseActionToken validates an emailed token of the given type
+func parseActionToken(tokenString, tokenSecret string, tokenType TokenType) (actionClaims, error) {
+	claims := actionClaims{}
+	_, err := jwt.ParseWithClaims(
+		tokenString,
+		&claims,
+		func(token *jwt.Token) (interface{}, error) { return []byte(tokenSecret), nil },
+	)
+	if err != nil {
+		return actionClaims{}, err
+	}
+	if claims.Issuer != string(tokenType) {
+		return actionClaims{}, errors.New("invalid issuer")
+	}
+	if claims.ID == "" {
+		return actionClaims{}, errors.New("missing token ID")
+	}
+	if claims.IssuedAt == nil {
+		return actionClaims{}, errors.New("missing issue time")
+	}
+	return claims, nil
+}
+
+// ConsumeActionToken marks a token ID as used, failing if it already was.
+// Entries are kept until the token would have expired anyway.
+func (db *DB) ConsumeActionToken(tokenID string, expiresAt time.Time) error {
+	return db.update(func(dbStruct *DBStructure) error {
+		now := time.Now().UTC()
+		for id, expiry := range dbStruct.UsedTokens {
+			if expiry.Before(now) {
+				delete(dbStruct.UsedTokens, id)
+			}
+		}
+		if _, used := dbStruct.UsedTokens[tokenID]; used {
+			return ErrTokenUsed
+		}
+		dbStruct.UsedTokens[tokenID] = expiresAt
+		return nil
+	})
+}
+
+// ActionTokenUsed reports whether a token ID was consumed and hasn't
+// expired yet
+func (db *DB) ActionTokenUsed(tokenID string) (bool, error) {
+	dbStruct, err := db.loadDB()
+	if err != nil {
+		return false, err
+	}
+	expiry, used := dbStruct.UsedTokens[tokenID]
+	return used && !expiry.Before(time.Now().UTC()), nil
+}
+
+// MarkEmailVerified sets the verified flag if the email still matches
+func (db *DB) MarkEmailVerified(userID int, email string) error {
+	_, err := db.modifyUser(userID, func(user *User) error {
+		if user.Email != email {
+			return fmt.Errorf("email has changed since the token was issued: %w", ErrConflict)
+		}
+		user.EmailVerified = true
+		return nil
+	})
+	return err
+}
+
+// ResetPassword stores a new password hash for the user. It fails for a
+// token issued before the last reset, so a reset revokes every other
+// outstanding reset link.
+func (db *DB) ResetPassword(userID int, email, hashedPassword string, issuedAt time.Time) error {
+	_, err := db.modifyUser(userID, func(user *User) error {
+		if user.Email != email {
+			return fmt.Errorf("email has changed since the token was issued: %w", ErrConflict)
+		}
+		// token times only have second precision, so a token from the
+		// same second as the last reset counts as older
+		if user.PasswordResetAt != nil && !issuedAt.After(*user.PasswordResetAt) {
+			return fmt.Errorf("password was reset since the token was issued: %w", ErrConflict)
+		}
+		now := time.Now().UTC().Truncate(time.Second)
+		user.Password = hashedPassword
+		user.PasswordResetAt = &now
+		return nil
+	})
+	return err
+}
+
+// consumeActionToken validates a token and records it as used
+func (cfg *apiConfig) consumeActionToken(tokenString string, tokenType TokenType) (int, actionClaims, error) {
+	claims, err := parseActionToken(tokenString, cfg.jwtSecret, tokenType)
+	if err != nil {
+		return 0, actionClaims{}, err
+	}
+	userID, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return 0, actionClaims{}, err
+	}
+	if err := cfg.database.ConsumeActionToken(claims.ID, claims.ExpiresAt.Time); err != nil {
+		return 0, actionClaims{}, err
+	}
+	return userID, claims, nil
+}
+
+// sendVerificationEmail mails a verification link to the user
+func (cfg *apiConfig) sendVerificationEmail(user User) error {
+	token, err := makeActionToken(user, cfg.jwtSecret, emailVerificationTTL, TokenTypeVerifyEmail)
+	if err != nil {
+		return err
+	}
+	body := fmt.Sprintf(
+		"Confirm your Chirpy email address by opening the link below.\n\n%s/app/verify?token=%s\n\nThe link expires in 48 hours.",
+		cfg.baseURL, token,
+	)
+	return cfg.mailer.SendMail(user.Email, "Verify your Chirpy email", body)
+}
+
+// sendPasswordResetEmail mails a password reset link to the user
+func (cfg *apiConfig) sendPasswordResetEmail(user User) error {
+	token, err := makeActionToken(user, cfg.jwtSecret, passwordResetTTL, TokenTypePasswordReset)
+	if err != nil {
+		return err
+	}
+	body := fmt.Sprintf(
+		"Someone asked to reset your Chirpy password. If it was you, open the link below.\n\n%s/app/reset?token=%s\n\nThe link expires in 1 hour. If you didn't ask for this you can ignore this email.",
+		cfg.baseURL, token,
+	)
+	return cfg.mailer.SendMail(user.Email, "Reset your Chirpy password", body)
+}
+
+func (cfg *apiConfig) handlerRequestVerification(w http.ResponseWriter, r *http.Request) {
+	userID, err := cfg.getAuthenticatedUserID(r)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	user, err := cfg.database.GetUserByID(userID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "User not found")
+		return
+	}
+	if user.EmailVerified {
+		respondWithError(w, http.StatusConflict, "Email already verified")
+		return
+	}
+
+	if err := cfg.sendVerificationEmail(user); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to send verification email")
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (cfg *apiConfig) handlerVerifyEmail(w http.ResponseWriter, r *http.Request) {
+	var verifyRequest struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&verifyRequest); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	userID, claims, err := cfg.consumeActionToken(verifyRequest.Token, TokenTypeVerifyEmail)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid or expired verification token")
+		return
+	}
+
+	if err := cfg.database.MarkEmailVerified(userID, claims.Email); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid or expired verification token")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"id":             userID,
+		"email":          claims.Email,
+		"email_verified": true,
+	})
+}
+
+func (cfg *apiConfig) handlerForgotPassword(w http.ResponseWriter, r *http.Request) {
+	var forgotRequest struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&forgotRequest); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	// always answer the same way and just as fast so the endpoint can't be
+	// used to find accounts; the mail goes out in the background
+	user, err := cfg.database.GetUserByEmail(forgotRequest.Email)
+	if err == nil {
+		go func() {
+			if err := cfg.sendPasswordResetEmail(user); err != nil {
+				log.Printf("Error sending password reset email: %v", err)
+			}
+		}()
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (cfg *apiConfig) handlerResetPassword(w http.ResponseWriter, r *http.Request) {
+	var resetRequest struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&resetRequest); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if msg := cfg.passwordPolicy.Validate(resetRequest.Password); msg != "" {
+		respondWithValidationErrors(w, FieldErrors{"password": msg})
+		return
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(resetRequest.Password), bcrypt.DefaultCost)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error hashing password")
+		return
+	}
+
+	userID, claims, err := cfg.consumeActionToken(resetRequest.Token, TokenTypePasswordReset)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid or expired reset token")
+		return
+	}
+
+	if err := cfg.database.ResetPassword(userID, claims.Email, string(hashedPassword), claims.IssuedAt.Time); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid or expired reset token")
+		return
+	}
+
+	// a successful reset lifts any lockout on the account
+	if err := cfg.database.ClearLoginAttempts(loginAttemptKeys(claims.Email, "")); err != nil {
+		log.Printf("Error clearing login attempts: %v", err)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
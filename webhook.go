@@ -4,61 +4,52 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"time"
 )
 
-func (db *DB) UpgradeUserToChirpyRed(userID int) error {
-	dbStruct, err := db.loadDB()
-	if err != nil {
-		return err
-	}
-
-	user, ok := dbStruct.Users[userID]
-	if !ok {
-		return fmt.Errorf("user not found")
-	}
-
-	user.IsChirpyRed = true
-	dbStruct.Users[userID] = user
-
-	return db.writeDB(dbStruct)
+// polkaEvent is the body Polka sends
+type polkaEvent struct {
+	// ID is the same across retries of one delivery
+	ID    string `json:"id"`
+	Event string `json:"event"`
+	Data  struct {
+		UserID int `json:"user_id"`
+		// PeriodEnd is when the paid period ends, if Polka sends it
+		PeriodEnd *time.Time `json:"period_end"`
+	} `json:"data"`
 }
 
-func (cfg *apiConfig) handlePolkaWebhooks(w http.ResponseWriter, r *http.Request) {
-	apiKeyHeader := r.Header.Get("Authorization")
-	expectedAuthHeader := "ApiKey " + cfg.polkaAPIKey
-
-	if apiKeyHeader != expectedAuthHeader {
-		respondWithError(w, http.StatusUnauthorized, "Unauthorized: Invalid API key")
-		return
+// polkaProvider handles Chirpy Red billing events from Polka
+func (cfg *apiConfig) polkaProvider(verifier WebhookVerifier) *WebhookProvider {
+	handlers := make(map[string]WebhookHandler, len(subscriptionEvents))
+	for event := range subscriptionEvents {
+		handlers[event] = cfg.applyPolkaEvent
 	}
-
-	var webhook struct {
-		Event string `json:"event"`
-		Data  struct {
-			UserID int `json:"user_id"`
-		} `json:"data"`
-	}
-
-	if err := json.NewDecoder(r.Body).Decode(&webhook); err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid request body")
-		return
-	}
-
-	// Respond immediately for non-relevant events
-	if webhook.Event != "user.upgraded" {
-		w.WriteHeader(http.StatusOK)
-		return
+	return &WebhookProvider{
+		Name:     "polka",
+		Verifier: verifier,
+		Decode: func(payload []byte) (WebhookEnvelope, error) {
+			var webhook polkaEvent
+			if err := json.Unmarshal(payload, &webhook); err != nil {
+				return WebhookEnvelope{}, err
+			}
+			return WebhookEnvelope{ID: webhook.ID, Type: webhook.Event}, nil
+		},
+		Handlers: handlers,
 	}
+}
 
-	// Upgrade the user in database
-	if err := cfg.database.UpgradeUserToChirpyRed(webhook.Data.UserID); err != nil {
-		if err.Error() == "user not found" {
-			respondWithError(w, http.StatusNotFound, "User not found")
-		} else {
-			respondWithError(w, http.StatusInternalServerError, "Failed to upgrade user")
-		}
-		return
+// applyPolkaEvent updates a user's subscription from a stored payload
+func (cfg *apiConfig) applyPolkaEvent(payload []byte) error {
+	var webhook polkaEvent
+	if err := json.Unmarshal(payload, &webhook); err != nil {
+		return fmt.Errorf("decoding payload: %w", err)
 	}
+	_, err := cfg.database.ApplySubscriptionEvent(webhook.Data.UserID, webhook.Event, webhook.Data.PeriodEnd)
+	return err
+}
 
-	w.WriteHeader(http.StatusOK)
+// handlePolkaWebhooks serves the original Polka URL
+func (cfg *apiConfig) handlePolkaWebhooks(w http.ResponseWriter, r *http.Request) {
+	cfg.serveWebhook(w, r, "polka")
 }
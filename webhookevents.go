@@ -0,0 +1,232 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	WebhookProcessing = "processing"
+	WebhookProcessed  = "processed"
+	WebhookIgnored    = "ignored"
+	WebhookFailed     = "failed"
+
+	// webhookEventRetention is how long finished events are kept
+	webhookEventRetention = 30 * 24 * time.Hour
+	// webhookClaimTimeout is how long an event may stay processing before
+	// it's assumed the server died mid-way and it can be claimed again
+	webhookClaimTimeout = 10 * time.Minute
+)
+
+// ErrWebhookInProgress -
+var ErrWebhookInProgress = fmt.Errorf("event is being processed: %w", ErrConflict)
+
+// WebhookEvent is a received webhook and what became of it
+type WebhookEvent struct {
+	Provider    string          `json:"provider"`
+	ID          string          `json:"id"`
+	Event       string          `json:"event"`
+	Payload     json.RawMessage `json:"payload"`
+	Status      string          `json:"status"`
+	Error       string          `json:"error,omitempty"`
+	Attempts    int             `json:"attempts"`
+	ReceivedAt  time.Time       `json:"received_at"`
+	ClaimedAt   *time.Time      `json:"claimed_at,omitempty"`
+	ProcessedAt *time.Time      `json:"processed_at,omitempty"`
+}
+
+// inProgress reports whether someone is still processing the event.
+// Claims older than webhookClaimTimeout are stale.
+func (e WebhookEvent) inProgress(now time.Time) bool {
+	if e.Status != WebhookProcessing {
+		return false
+	}
+	claimedAt := e.ReceivedAt
+	if e.ClaimedAt != nil {
+		claimedAt = *e.ClaimedAt
+	}
+	return now.Sub(claimedAt) < webhookClaimTimeout
+}
+
+func webhookEventKey(provider, id string) string {
+	return provider + ":" + id
+}
+
+// webhookEventID is the ID a payload carries, or a hash of the payload
+// for senders that don't send one, so identical retries still match
+func webhookEventID(id string, payload []byte) string {
+	if id != "" {
+		return id
+	}
+	sum := sha256.Sum256(payload)
+	return "sha256-" + hex.EncodeToString(sum[:16])
+}
+
+// pruneWebhookEvents drops finished events past their retention
+func (s *DBStructure) pruneWebhookEvents(now time.Time) {
+	for key, event := range s.WebhookEvents {
+		if event.Status != WebhookFailed && event.ReceivedAt.Before(now.Add(-webhookEventRetention)) {
+			delete(s.WebhookEvents, key)
+		}
+	}
+}
+
+// BeginWebhookEvent records an incoming event and claims it for
+// processing. duplicate is true when the event was already handled, in
+// which case it must not be applied again. Failed events and stale
+// claims can be retried.
+func (db *DB) BeginWebhookEvent(provider, id, eventType string, payload []byte) (event WebhookEvent, duplicate bool, err error) {
+	err = db.update(func(dbStruct *DBStructure) error {
+		now := time.Now().UTC()
+		dbStruct.pruneWebhookEvents(now)
+
+		key := webhookEventKey(provider, id)
+		existing, ok := dbStruct.WebhookEvents[key]
+		if ok {
+			switch existing.Status {
+			case WebhookProcessed, WebhookIgnored:
+				event, duplicate = existing, true
+				return nil
+			}
+			if existing.inProgress(now) {
+				return ErrWebhookInProgress
+			}
+			event = existing
+		} else {
+			event = WebhookEvent{
+				Provider:   provider,
+				ID:         id,
+				Event:      eventType,
+				Payload:    json.RawMessage(payload),
+				ReceivedAt: now,
+			}
+		}
+		event.Status = WebhookProcessing
+		event.ClaimedAt = &now
+		event.Attempts++
+		dbStruct.WebhookEvents[key] = event
+		return nil
+	})
+	return event, duplicate, err
+}
+
+// ClaimWebhookEvent marks a stored event as being processed again, for
+// replays
+func (db *DB) ClaimWebhookEvent(provider, id string) (WebhookEvent, error) {
+	var event WebhookEvent
+	err := db.update(func(dbStruct *DBStructure) error {
+		key := webhookEventKey(provider, id)
+		var ok bool
+		event, ok = dbStruct.WebhookEvents[key]
+		if !ok {
+			return fmt.Errorf("webhook event %w", ErrNotFound)
+		}
+		now := time.Now().UTC()
+		if event.inProgress(now) {
+			return ErrWebhookInProgress
+		}
+		event.Status = WebhookProcessing
+		event.ClaimedAt = &now
+		event.Attempts++
+		dbStruct.WebhookEvents[key] = event
+		return nil
+	})
+	return event, err
+}
+
+// FinishWebhookEvent stores the outcome of processing an event
+func (db *DB) FinishWebhookEvent(provider, id, status string, procErr error) (WebhookEvent, error) {
+	var event WebhookEvent
+	err := db.update(func(dbStruct *DBStructure) error {
+		key := webhookEventKey(provider, id)
+		var ok bool
+		event, ok = dbStruct.WebhookEvents[key]
+		if !ok {
+			return fmt.Errorf("webhook event %w", ErrNotFound)
+		}
+		now := time.Now().UTC()
+		event.Status = status
+		event.Error = ""
+		if procErr != nil {
+			event.Error = procErr.Error()
+		}
+		event.ProcessedAt = &now
+		dbStruct.WebhookEvents[key] = event
+		return nil
+	})
+	return event, err
+}
+
+// GetWebhookEvents lists stored events, newest first. Empty filters
+// match everything.
+func (db *DB) GetWebhookEvents(provider, status string) ([]WebhookEvent, error) {
+	dbStruct, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+
+	events := []WebhookEvent{}
+	for _, event := range dbStruct.WebhookEvents {
+		if (provider == "" || event.Provider == provider) && (status == "" || event.Status == status) {
+			events = append(events, event)
+		}
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].ReceivedAt.After(events[j].ReceivedAt) })
+	return events, nil
+}
+
+// GetWebhookEvent returns one stored event
+func (db *DB) GetWebhookEvent(provider, id string) (WebhookEvent, error) {
+	dbStruct, err := db.loadDB()
+	if err != nil {
+		return WebhookEvent{}, err
+	}
+	event, ok := dbStruct.WebhookEvents[webhookEventKey(provider, id)]
+	if !ok {
+		return WebhookEvent{}, fmt.Errorf("webhook event %w", ErrNotFound)
+	}
+	return event, nil
+}
+
+func (cfg *apiConfig) handlerGetWebhookEvents(w http.ResponseWriter, r *http.Request) {
+	events, err := cfg.database.GetWebhookEvents(r.URL.Query().Get("provider"), r.URL.Query().Get("status"))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not retrieve webhook events")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, events)
+}
+
+func (cfg *apiConfig) handlerGetWebhookEvent(w http.ResponseWriter, r *http.Request) {
+	event, err := cfg.database.GetWebhookEvent(chi.URLParam(r, "provider"), chi.URLParam(r, "eventID"))
+	if err != nil {
+		respondWithDBError(w, err, "Webhook event not found")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, event)
+}
+
+// handlerReplayWebhookEvent applies a stored event again, whatever its
+// previous outcome, e.g. after fixing whatever made it fail
+func (cfg *apiConfig) handlerReplayWebhookEvent(w http.ResponseWriter, r *http.Request) {
+	event, err := cfg.database.ClaimWebhookEvent(chi.URLParam(r, "provider"), chi.URLParam(r, "eventID"))
+	if err != nil {
+		respondWithDBError(w, err, "Could not replay webhook event")
+		return
+	}
+
+	event, err = cfg.processWebhookEvent(event)
+	if err != nil && event.Status != WebhookFailed {
+		respondWithDBError(w, err, "Could not record webhook outcome")
+		return
+	}
+	// a failed replay is still a completed request, the event says why
+	respondWithJSON(w, http.StatusOK, event)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// WebhookEnvelope is what the framework needs to know about a payload
+type WebhookEnvelope struct {
+	// ID identifies the delivery across retries, may be empty
+	ID string
+	// Type selects the handler
+	Type string
+}
+
+// WebhookHandler applies one event. Returning an error wrapping
+// ErrInvalidInput marks the event ignored rather than failed.
+type WebhookHandler func(payload []byte) error
+
+// WebhookProvider describes a service that sends us webhooks. It is
+// served at /api/webhooks/{Name}.
+type WebhookProvider struct {
+	Name     string
+	Verifier WebhookVerifier
+	// Decode reads the envelope from a raw payload
+	Decode func(payload []byte) (WebhookEnvelope, error)
+	// Handlers by event type; events without one are stored and ignored
+	Handlers map[string]WebhookHandler
+}
+
+// registerWebhookProvider makes a provider available to webhook routes
+// and replays
+func (cfg *apiConfig) registerWebhookProvider(provider *WebhookProvider) {
+	if cfg.webhookProviders == nil {
+		cfg.webhookProviders = make(map[string]*WebhookProvider)
+	}
+	cfg.webhookProviders[provider.Name] = provider
+}
+
+// processWebhookEvent applies a claimed event and records the outcome.
+// Events the provider doesn't handle are marked ignored.
+func (cfg *apiConfig) processWebhookEvent(event WebhookEvent) (WebhookEvent, error) {
+	var procErr error
+	provider, ok := cfg.webhookProviders[event.Provider]
+	if !ok {
+		procErr = fmt.Errorf("unknown provider %q", event.Provider)
+	} else if handler, ok := provider.Handlers[event.Event]; ok {
+		procErr = handler(event.Payload)
+	} else {
+		procErr = fmt.Errorf("no handler for %q: %w", event.Event, ErrInvalidInput)
+	}
+
+	status := WebhookProcessed
+	switch {
+	case errors.Is(procErr, ErrInvalidInput):
+		status, procErr = WebhookIgnored, nil
+	case procErr != nil:
+		status = WebhookFailed
+	}
+
+	finished, err := cfg.database.FinishWebhookEvent(event.Provider, event.ID, status, procErr)
+	if err != nil {
+		return event, err
+	}
+	return finished, procErr
+}
+
+func (cfg *apiConfig) handlerWebhooks(w http.ResponseWriter, r *http.Request) {
+	cfg.serveWebhook(w, r, chi.URLParam(r, "provider"))
+}
+
+// serveWebhook authenticates, records and applies a webhook for the
+// named provider
+func (cfg *apiConfig) serveWebhook(w http.ResponseWriter, r *http.Request, name string) {
+	provider, ok := cfg.webhookProviders[name]
+	if !ok {
+		respondWithError(w, http.StatusNotFound, "Unknown webhook provider")
+		return
+	}
+
+	// signatures cover the raw body, so read it before decoding
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBodyBytes))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	replay, acceptUntil, err := provider.Verifier.Verify(r.Header, body, time.Now())
+	if err != nil {
+		respondWithWebhookAuthError(w, err)
+		return
+	}
+	// a captured request can't be replayed while its timestamp is still
+	// inside the tolerance window. The key is only consumed once the event
+	// was applied, so the sender can retry after a failure.
+	replayID := "webhook:" + provider.Name + ":" + replay
+	if replay != "" {
+		used, err := cfg.database.ActionTokenUsed(replayID)
+		if err != nil {
+			respondWithDBError(w, err, "Failed to record webhook")
+			return
+		}
+		if used {
+			respondWithWebhookAuthError(w, ErrReplayedWebhook)
+			return
+		}
+	}
+
+	envelope, err := provider.Decode(body)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	event, duplicate, err := cfg.database.BeginWebhookEvent(provider.Name, webhookEventID(envelope.ID, body), envelope.Type, body)
+	if err != nil {
+		respondWithDBError(w, err, "Event is already being processed")
+		return
+	}
+	if duplicate {
+		// already applied, acknowledge so the sender stops retrying
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if _, err := cfg.processWebhookEvent(event); err != nil {
+		respondWithDBError(w, err, "Failed to process event")
+		return
+	}
+	if replay != "" {
+		// a concurrent copy of the request may have got here first, the
+		// event log already kept it from being applied twice
+		err := cfg.database.ConsumeActionToken(replayID, acceptUntil)
+		if err != nil && !errors.Is(err, ErrTokenUsed) {
+			log.Printf("Failed to record webhook %s/%s as received: %v", provider.Name, event.ID, err)
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
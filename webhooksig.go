@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Webhook authentication modes
+const (
+	// WebhookModeHMAC requires a valid signature
+	WebhookModeHMAC = "hmac"
+	// WebhookModeAPIKey accepts the old static Authorization: ApiKey header
+	WebhookModeAPIKey = "apikey"
+	// WebhookModeEither accepts either, for moving senders over to HMAC
+	WebhookModeEither = "either"
+)
+
+const (
+	defaultWebhookTolerance = 5 * time.Minute
+	maxWebhookBodyBytes     = 1 << 20
+	signaturePrefix         = "sha256="
+)
+
+var (
+	// ErrBadSignature -
+	ErrBadSignature = errors.New("invalid webhook signature")
+	// ErrStaleWebhook -
+	ErrStaleWebhook = errors.New("webhook timestamp outside tolerance")
+	// ErrReplayedWebhook -
+	ErrReplayedWebhook = errors.New("webhook already received")
+)
+
+// WebhookVerifier authenticates incoming webhooks. Signed requests carry
+// a unix timestamp and one or more signatures, each
+// "sha256=" + hex(HMAC-SHA256(secret, timestamp + "." + body)).
+type WebhookVerifier struct {
+	Mode string
+	// Secrets are all accepted, so a new one can be added before the
+	// sender switches to it and the old one removed afterwards
+	Secrets         []string
+	APIKey          string
+	Tolerance       time.Duration
+	TimestampHeader string
+	SignatureHeader string
+}
+
+// polkaVerifierFromEnv reads POLKA_WEBHOOK_MODE, POLKA_WEBHOOK_SECRETS
+// (comma separated), POLKA_WEBHOOK_TOLERANCE (seconds) and POLKA_API_KEY
+func polkaVerifierFromEnv() (WebhookVerifier, error) {
+	v := WebhookVerifier{
+		APIKey:          os.Getenv("POLKA_API_KEY"),
+		Tolerance:       defaultWebhookTolerance,
+		TimestampHeader: "X-Polka-Timestamp",
+		SignatureHeader: "X-Polka-Signature",
+	}
+	for _, secret := range strings.Split(os.Getenv("POLKA_WEBHOOK_SECRETS"), ",") {
+		if secret = strings.TrimSpace(secret); secret != "" {
+			v.Secrets = append(v.Secrets, secret)
+		}
+	}
+
+	v.Mode = os.Getenv("POLKA_WEBHOOK_MODE")
+	if v.Mode == "" {
+		// keep existing ApiKey setups working until secrets are configured
+		v.Mode = WebhookModeAPIKey
+		if len(v.Secrets) > 0 {
+			v.Mode = WebhookModeHMAC
+		}
+	}
+	switch v.Mode {
+	case WebhookModeHMAC, WebhookModeAPIKey, WebhookModeEither:
+	default:
+		return WebhookVerifier{}, fmt.Errorf("POLKA_WEBHOOK_MODE must be %q, %q or %q", WebhookModeHMAC, WebhookModeAPIKey, WebhookModeEither)
+	}
+	if v.Mode != WebhookModeAPIKey && len(v.Secrets) == 0 {
+		return WebhookVerifier{}, fmt.Errorf("POLKA_WEBHOOK_SECRETS is required in %s mode", v.Mode)
+	}
+	if v.Mode != WebhookModeHMAC && v.APIKey == "" {
+		return WebhookVerifier{}, fmt.Errorf("POLKA_API_KEY is required in %s mode", v.Mode)
+	}
+
+	if s := os.Getenv("POLKA_WEBHOOK_TOLERANCE"); s != "" {
+		seconds, err := strconv.Atoi(s)
+		if err != nil || seconds <= 0 {
+			return WebhookVerifier{}, fmt.Errorf("POLKA_WEBHOOK_TOLERANCE must be a positive number of seconds")
+		}
+		v.Tolerance = time.Duration(seconds) * time.Second
+	}
+	return v, nil
+}
+
+// signWebhook computes the signature header value for body
+func signWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return signaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// replayKey identifies a signed request by what the signatures cover, so
+// the same request sent with a different signature still matches
+func replayKey(timestamp int64, body []byte) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%d.", timestamp)
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Verify checks a webhook request. For signed requests it returns a key
+// for the timestamp and body and when it stops being acceptable, so the
+// caller can refuse to process it twice. Both are empty for ApiKey
+// requests.
+func (v WebhookVerifier) Verify(header http.Header, body []byte, now time.Time) (string, time.Time, error) {
+	signed := header.Get(v.SignatureHeader) != ""
+	if v.Mode == WebhookModeAPIKey || (v.Mode == WebhookModeEither && !signed) {
+		expected := "ApiKey " + v.APIKey
+		if subtle.ConstantTimeCompare([]byte(header.Get("Authorization")), []byte(expected)) != 1 {
+			return "", time.Time{}, ErrBadSignature
+		}
+		return "", time.Time{}, nil
+	}
+
+	timestamp, err := strconv.ParseInt(header.Get(v.TimestampHeader), 10, 64)
+	if err != nil {
+		return "", time.Time{}, ErrBadSignature
+	}
+	sentAt := time.Unix(timestamp, 0)
+	if sentAt.Before(now.Add(-v.Tolerance)) || sentAt.After(now.Add(v.Tolerance)) {
+		return "", time.Time{}, ErrStaleWebhook
+	}
+
+	// the sender may include several signatures while rotating secrets
+	for _, given := range strings.Split(header.Get(v.SignatureHeader), ",") {
+		given = strings.TrimSpace(given)
+		for _, secret := range v.Secrets {
+			if hmac.Equal([]byte(given), []byte(signWebhook(secret, timestamp, body))) {
+				return replayKey(timestamp, body), sentAt.Add(v.Tolerance), nil
+			}
+		}
+	}
+	return "", time.Time{}, ErrBadSignature
+}
+
+// respondWithWebhookAuthError answers a request that failed Verify
+func respondWithWebhookAuthError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrStaleWebhook):
+		respondWithProblem(w, http.StatusUnauthorized, "stale_webhook", "Webhook timestamp is too old or in the future", nil)
+	case errors.Is(err, ErrReplayedWebhook):
+		respondWithProblem(w, http.StatusUnauthorized, "replayed_webhook", "Webhook was already received", nil)
+	default:
+		respondWithProblem(w, http.StatusUnauthorized, "invalid_signature", "Unauthorized: Invalid webhook signature", nil)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+const (
+	testWebhookTimestamp = 1700000000
+	testWebhookBody      = `{"event":"user.upgraded","data":{"user_id":3}}`
+)
+
+func TestSignWebhookVector(t *testing.T) {
+	// HMAC-SHA256("whsec_test", "1700000000." + body), computed with
+	// Python's hmac module
+	want := "sha256=c7ea864119063ab8d0073098af05985a4ff943a3aa1e744431239e8862ff3efa"
+	if got := signWebhook("whsec_test", testWebhookTimestamp, []byte(testWebhookBody)); got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+}
+
+func testVerifier(mode string, secrets ...string) WebhookVerifier {
+	return WebhookVerifier{
+		Mode:            mode,
+		Secrets:         secrets,
+		APIKey:          "f271c81ff7084ee5b99a5091b42d486e",
+		Tolerance:       defaultWebhookTolerance,
+		TimestampHeader: "X-Polka-Timestamp",
+		SignatureHeader: "X-Polka-Signature",
+	}
+}
+
+func signedHeader(timestamp int64, signatures string) http.Header {
+	header := http.Header{}
+	header.Set("X-Polka-Timestamp", strconv.FormatInt(timestamp, 10))
+	header.Set("X-Polka-Signature", signatures)
+	return header
+}
+
+func TestWebhookVerify(t *testing.T) {
+	body := []byte(testWebhookBody)
+	now := time.Unix(testWebhookTimestamp, 0).Add(time.Minute)
+	oldSig := signWebhook("old-secret", testWebhookTimestamp, body)
+	newSig := signWebhook("new-secret", testWebhookTimestamp, body)
+
+	tests := []struct {
+		name     string
+		verifier WebhookVerifier
+		header   http.Header
+		body     string
+		wantErr  error
+	}{
+		{
+			name:     "valid",
+			verifier: testVerifier(WebhookModeHMAC, "new-secret"),
+			header:   signedHeader(testWebhookTimestamp, newSig),
+		},
+		{
+			name:     "rotation, sender still on the old secret",
+			verifier: testVerifier(WebhookModeHMAC, "new-secret", "old-secret"),
+			header:   signedHeader(testWebhookTimestamp, oldSig),
+		},
+		{
+			name:     "rotation, sender sends both",
+			verifier: testVerifier(WebhookModeHMAC, "new-secret"),
+			header:   signedHeader(testWebhookTimestamp, oldSig+", "+newSig),
+		},
+		{
+			name:     "unknown secret",
+			verifier: testVerifier(WebhookModeHMAC, "new-secret"),
+			header:   signedHeader(testWebhookTimestamp, oldSig),
+			wantErr:  ErrBadSignature,
+		},
+		{
+			name:     "body changed",
+			verifier: testVerifier(WebhookModeHMAC, "new-secret"),
+			header:   signedHeader(testWebhookTimestamp, newSig),
+			body:     `{"event":"user.upgraded","data":{"user_id":4}}`,
+			wantErr:  ErrBadSignature,
+		},
+		{
+			name:     "timestamp changed",
+			verifier: testVerifier(WebhookModeHMAC, "new-secret"),
+			header:   signedHeader(testWebhookTimestamp+1, newSig),
+			wantErr:  ErrBadSignature,
+		},
+		{
+			name:     "too old",
+			verifier: testVerifier(WebhookModeHMAC, "new-secret"),
+			header:   signedHeader(testWebhookTimestamp-600, signWebhook("new-secret", testWebhookTimestamp-600, body)),
+			wantErr:  ErrStaleWebhook,
+		},
+		{
+			name:     "api key in hmac mode",
+			verifier: testVerifier(WebhookModeHMAC, "new-secret"),
+			header:   http.Header{"Authorization": {"ApiKey f271c81ff7084ee5b99a5091b42d486e"}},
+			wantErr:  ErrBadSignature,
+		},
+		{
+			name:     "api key in either mode",
+			verifier: testVerifier(WebhookModeEither, "new-secret"),
+			header:   http.Header{"Authorization": {"ApiKey f271c81ff7084ee5b99a5091b42d486e"}},
+		},
+		{
+			name:     "wrong api key",
+			verifier: testVerifier(WebhookModeAPIKey),
+			header:   http.Header{"Authorization": {"ApiKey wrong"}},
+			wantErr:  ErrBadSignature,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reqBody := body
+			if tt.body != "" {
+				reqBody = []byte(tt.body)
+			}
+			_, _, err := tt.verifier.Verify(tt.header, reqBody, now)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestWebhookReplayKey(t *testing.T) {
+	body := []byte(testWebhookBody)
+	now := time.Unix(testWebhookTimestamp, 0)
+	verifier := testVerifier(WebhookModeHMAC, "new-secret", "old-secret")
+
+	key, acceptUntil, err := verifier.Verify(signedHeader(testWebhookTimestamp, signWebhook("new-secret", testWebhookTimestamp, body)), body, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "ce2f9792a16ff105fcd56332f1d7642216b23a7931f6a50080f67c5f33dda92f"; key != want {
+		t.Fatalf("replay key %s, want sha256 of timestamp and body %s", key, want)
+	}
+	if want := now.Add(defaultWebhookTolerance); !acceptUntil.Equal(want) {
+		t.Fatalf("accepted until %v, want %v", acceptUntil, want)
+	}
+
+	// resending the same request under the other secret during a
+	// rotation must still count as a replay
+	otherKey, _, err := verifier.Verify(signedHeader(testWebhookTimestamp, signWebhook("old-secret", testWebhookTimestamp, body)), body, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if otherKey != key {
+		t.Fatalf("replay key depends on the signature: %s != %s", otherKey, key)
+	}
+
+	// API key requests have nothing to key on
+	key, _, err = testVerifier(WebhookModeEither, "new-secret").Verify(http.Header{"Authorization": {"ApiKey f271c81ff7084ee5b99a5091b42d486e"}}, body, now)
+	if err != nil || key != "" {
+		t.Fatalf("api key request: key %q, err %v", key, err)
+	}
+}
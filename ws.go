@@ -0,0 +1,438 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	wsPingInterval = 30 * time.Second
+	// wsReadTimeout must be longer than wsPingInterval so the pong for
+	// the last ping has time to arrive
+	wsReadTimeout     = 60 * time.Second
+	wsWriteTimeout    = 10 * time.Second
+	wsCloseTimeout    = 5 * time.Second
+	wsMaxMessageBytes = 4096
+	// wsSendBuffer is how far a client may fall behind before it is
+	// disconnected
+	wsSendBuffer       = 64
+	wsMaxSubscriptions = 50
+
+	// wsCloseTokenExpired is sent when the access token runs out and
+	// wasn't replaced with an auth message
+	wsCloseTokenExpired = 4001
+
+	WSChannelTimeline = "timeline"
+)
+
+var (
+	chirpMentionPattern = regexp.MustCompile(`(?:^|[^A-Za-z0-9_])@([A-Za-z][A-Za-z0-9_]{2,14})\b`)
+	chirpTagPattern     = regexp.MustCompile(`(?:^|[^A-Za-z0-9_&])#([A-Za-z0-9_]{1,50})\b`)
+)
+
+// chirpTags returns the lowercased hashtags in a chirp body, once each
+func chirpTags(body string) []string {
+	return uniqueMatches(chirpTagPattern, body)
+}
+
+func uniqueMatches(pattern *regexp.Regexp, body string) []string {
+	seen := make(map[string]bool)
+	var matches []string
+	for _, match := range pattern.FindAllStringSubmatch(body, -1) {
+		key := strings.ToLower(match[1])
+		if !seen[key] {
+			seen[key] = true
+			matches = append(matches, key)
+		}
+	}
+	return matches
+}
+
+// parseWSChannel validates a channel name and returns its canonical form:
+// "timeline", "author:{id}" or "tag:{tag}"
+func parseWSChannel(channel string) (string, error) {
+	kind, arg, _ := strings.Cut(strings.TrimSpace(channel), ":")
+	switch kind {
+	case WSChannelTimeline:
+		if arg != "" {
+			return "", errors.New("timeline takes no argument")
+		}
+		return WSChannelTimeline, nil
+	case "author":
+		id, err := strconv.Atoi(arg)
+		if err != nil || id <= 0 {
+			return "", errors.New("author channels look like author:{id}")
+		}
+		return "author:" + strconv.Itoa(id), nil
+	case "tag":
+		tag := strings.ToLower(strings.TrimPrefix(arg, "#"))
+		if tags := chirpTags("#" + tag); len(tags) != 1 || tags[0] != tag {
+			return "", errors.New("tag channels look like tag:{tag}")
+		}
+		return "tag:" + tag, nil
+	}
+	return "", fmt.Errorf("unknown channel %q", channel)
+}
+
+// chirpChannels are the channels a chirp event is sent to
+func chirpChannels(chirp Chirp) []string {
+	channels := []string{WSChannelTimeline, "author:" + strconv.Itoa(chirp.AuthorID)}
+	for _, tag := range chirpTags(chirp.Body) {
+		channels = append(channels, "tag:"+tag)
+	}
+	return channels
+}
+
+// wsClientMessage is what clients send
+type wsClientMessage struct {
+	Type    string `json:"type"`
+	Channel string `json:"channel,omitempty"`
+	Token   string `json:"token,omitempty"`
+	// ID is echoed in the reply so clients can match them up
+	ID string `json:"id,omitempty"`
+}
+
+// wsServerMessage is what the server sends
+type wsServerMessage struct {
+	Type    string      `json:"type"`
+	ID      string      `json:"id,omitempty"`
+	Channel string      `json:"channel,omitempty"`
+	Data    interface{} `json:"data,omitempty"`
+	Error   string      `json:"error,omitempty"`
+}
+
+// wsClient is one connection and what it is subscribed to
+type wsClient struct {
+	conn   *wsConn
+	userID int
+	// expiresAt is when the access token expires, in unix nanoseconds
+	expiresAt atomic.Int64
+	// channels is guarded by the hub's mutex
+	channels map[string]bool
+	send     chan wsServerMessage
+	// kick carries the reason the server is closing the connection
+	kick chan *wsCloseError
+	done chan struct{}
+}
+
+// close asks the writer to close the connection. The first reason wins.
+func (c *wsClient) close(code int, reason string) {
+	select {
+	case c.kick <- &wsCloseError{code, reason}:
+	default:
+	}
+}
+
+// WSHub tracks WebSocket clients and pushes events to them
+type WSHub struct {
+	mu       sync.Mutex
+	clients  map[*wsClient]struct{}
+	shutdown bool
+	wg       sync.WaitGroup
+}
+
+// NewWSHub -
+func NewWSHub() *WSHub {
+	return &WSHub{
+		clients: make(map[*wsClient]struct{}),
+	}
+}
+
+// subscribeWSHub pushes chirp events and notifications to WebSocket
+// clients
+func subscribeWSHub(bus *EventBus, hub *WSHub) {
+	bus.SubscribeAsync(EventChirpCreated, hub.handleEvent)
+	bus.SubscribeAsync(EventChirpDeleted, hub.handleEvent)
+	bus.SubscribeAsync(EventNotificationAdded, hub.handleEvent)
+}
+
+func (h *WSHub) handleEvent(event Event) {
+	switch e := event.(type) {
+	case ChirpCreated:
+		h.broadcast(chirpChannels(e.Chirp), wsServerMessage{Type: EventChirpCreated, Data: e.Chirp})
+	case ChirpDeleted:
+		data := map[string]int{"id": e.Chirp.ID, "author_id": e.Chirp.AuthorID}
+		h.broadcast(chirpChannels(e.Chirp), wsServerMessage{Type: EventChirpDeleted, Data: data})
+	case NotificationAdded:
+		h.sendToUser(e.Notification.UserID, wsServerMessage{Type: "notification", Data: e})
+	}
+}
+
+// broadcast sends msg once to every client subscribed to any of the
+// channels, naming the first one that matched
+func (h *WSHub) broadcast(channels []string, msg wsServerMessage) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for client := range h.clients {
+		for _, channel := range channels {
+			if client.channels[channel] {
+				msg.Channel = channel
+				h.deliverLocked(client, msg)
+				break
+			}
+		}
+	}
+}
+
+// sendToUser sends msg to every connection of one user
+func (h *WSHub) sendToUser(userID int, msg wsServerMessage) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for client := range h.clients {
+		if client.userID == userID {
+			h.deliverLocked(client, msg)
+		}
+	}
+}
+
+// reply sends a response to something the client sent
+func (h *WSHub) reply(client *wsClient, msg wsServerMessage) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.clients[client]; ok {
+		h.deliverLocked(client, msg)
+	}
+}
+
+// deliverLocked queues a message without blocking. A client that can't
+// keep up is disconnected instead of holding up everyone else.
+func (h *WSHub) deliverLocked(client *wsClient, msg wsServerMessage) {
+	select {
+	case client.send <- msg:
+	default:
+		delete(h.clients, client)
+		client.close(wsCloseTryAgainLater, "too slow")
+	}
+}
+
+func (h *WSHub) add(client *wsClient) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.shutdown {
+		return false
+	}
+	h.clients[client] = struct{}{}
+	h.wg.Add(1)
+	return true
+}
+
+func (h *WSHub) remove(client *wsClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.clients, client)
+}
+
+func (h *WSHub) subscribe(client *wsClient, channel string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !client.channels[channel] && len(client.channels) >= wsMaxSubscriptions {
+		return fmt.Errorf("at most %d subscriptions per connection", wsMaxSubscriptions)
+	}
+	client.channels[channel] = true
+	return nil
+}
+
+func (h *WSHub) unsubscribe(client *wsClient, channel string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(client.channels, channel)
+}
+
+// Shutdown closes every connection with 1001 Going Away and waits for
+// them to finish, or for ctx to end. The HTTP server doesn't know about
+// upgraded connections, so this has to run alongside server.Shutdown.
+func (h *WSHub) Shutdown(ctx context.Context) error {
+	h.mu.Lock()
+	h.shutdown = true
+	for client := range h.clients {
+		client.close(wsCloseGoingAway, "server shutting down")
+	}
+	h.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		h.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// wsAccessToken reads the access token from the Authorization header or,
+// since browsers can't set headers on WebSocket requests, ?access_token=
+func wsAccessToken(r *http.Request) (string, error) {
+	if token := r.URL.Query().Get("access_token"); token != "" {
+		return token, nil
+	}
+	return GetBearerToken(r.Header)
+}
+
+// wsAuthenticate checks an access token and returns its user and expiry
+func (cfg *apiConfig) wsAuthenticate(token string) (int, time.Time, error) {
+	claims, err := ParseAccessToken(token, cfg.jwtSecret)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	userID, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	if err := cfg.checkUserActive(userID); err != nil {
+		return 0, time.Time{}, err
+	}
+	var expiresAt time.Time
+	if claims.ExpiresAt != nil {
+		expiresAt = claims.ExpiresAt.Time
+	}
+	return userID, expiresAt, nil
+}
+
+func (cfg *apiConfig) handlerWebSocket(w http.ResponseWriter, r *http.Request) {
+	// authenticate before upgrading so failures get a normal HTTP error
+	token, err := wsAccessToken(r)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Authorization token is required")
+		return
+	}
+	userID, expiresAt, err := cfg.wsAuthenticate(token)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	conn, err := upgradeWebSocket(w, r)
+	if err != nil {
+		return
+	}
+	defer conn.Teardown()
+
+	client := &wsClient{
+		conn:     conn,
+		userID:   userID,
+		channels: make(map[string]bool),
+		send:     make(chan wsServerMessage, wsSendBuffer),
+		kick:     make(chan *wsCloseError, 1),
+		done:     make(chan struct{}),
+	}
+	client.expiresAt.Store(expiresAt.UnixNano())
+
+	hub := cfg.wsHub
+	if !hub.add(client) {
+		conn.Close(wsCloseGoingAway, "server shutting down")
+		return
+	}
+	defer hub.wg.Done()
+	defer hub.remove(client)
+
+	go cfg.wsWriteLoop(client)
+	defer close(client.done)
+
+	hub.reply(client, wsServerMessage{Type: "welcome", Data: map[string]int{"user_id": userID}})
+	for {
+		opcode, message, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if opcode != wsOpText {
+			conn.Close(wsCloseUnsupported, "only text messages are supported")
+			return
+		}
+		cfg.handleWSMessage(client, message)
+	}
+}
+
+// handleWSMessage acts on one message from a client
+func (cfg *apiConfig) handleWSMessage(client *wsClient, message []byte) {
+	hub := cfg.wsHub
+	var msg wsClientMessage
+	if err := json.Unmarshal(message, &msg); err != nil {
+		hub.reply(client, wsServerMessage{Type: "error", Error: "invalid JSON"})
+		return
+	}
+	reply := wsServerMessage{ID: msg.ID}
+
+	switch msg.Type {
+	case "subscribe", "unsubscribe":
+		channel, err := parseWSChannel(msg.Channel)
+		if err != nil {
+			reply.Type, reply.Error = "error", err.Error()
+			break
+		}
+		reply.Channel = channel
+		if msg.Type == "unsubscribe" {
+			hub.unsubscribe(client, channel)
+			reply.Type = "unsubscribed"
+			break
+		}
+		if err := hub.subscribe(client, channel); err != nil {
+			reply.Type, reply.Error = "error", err.Error()
+			break
+		}
+		reply.Type = "subscribed"
+	case "auth":
+		// swaps in a fresh access token before the current one expires
+		userID, expiresAt, err := cfg.wsAuthenticate(msg.Token)
+		if err != nil || userID != client.userID {
+			reply.Type, reply.Error = "error", "invalid token"
+			break
+		}
+		client.expiresAt.Store(expiresAt.UnixNano())
+		reply.Type = "authenticated"
+	case "ping":
+		reply.Type = "pong"
+	default:
+		reply.Type, reply.Error = "error", fmt.Sprintf("unknown message type %q", msg.Type)
+	}
+	hub.reply(client, reply)
+}
+
+// wsWriteLoop is the only writer of data frames on a connection. It also
+// pings, and closes the connection when the hub or an expired token asks.
+func (cfg *apiConfig) wsWriteLoop(client *wsClient) {
+	conn := client.conn
+	ticker := time.NewTicker(wsPingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-client.done:
+			return
+		case closeErr := <-client.kick:
+			conn.Close(closeErr.Code, closeErr.Reason)
+			return
+		case msg := <-client.send:
+			dat, err := json.Marshal(msg)
+			if err != nil {
+				log.Printf("Error marshalling WebSocket message: %v", err)
+				continue
+			}
+			if err := conn.WriteText(dat); err != nil {
+				conn.Teardown()
+				return
+			}
+		case <-ticker.C:
+			if expiresAt := client.expiresAt.Load(); expiresAt > 0 && time.Now().UnixNano() > expiresAt {
+				conn.Close(wsCloseTokenExpired, "token expired")
+				return
+			}
+			if err := conn.Ping(); err != nil {
+				conn.Teardown()
+				return
+			}
+		}
+	}
+}
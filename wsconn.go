@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// The server side of RFC 6455, only as much as the API needs: no
+// extensions, no subprotocols, one reader and any number of writers.
+
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xA
+
+	wsCloseNormal          = 1000
+	wsCloseGoingAway       = 1001
+	wsCloseProtocolError   = 1002
+	wsCloseUnsupported     = 1003
+	wsCloseNoStatus        = 1005
+	wsCloseInvalidPayload  = 1007
+	wsClosePolicyViolation = 1008
+	wsCloseTooBig          = 1009
+	wsCloseTryAgainLater   = 1013
+
+	// wsGUID is mixed into the handshake key, see RFC 6455 section 1.3
+	wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+)
+
+var errWSClosed = errors.New("websocket closed")
+
+// wsCloseError is a close frame, sent or received
+type wsCloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *wsCloseError) Error() string {
+	return fmt.Sprintf("websocket closed: %d %s", e.Code, e.Reason)
+}
+
+// wsConn is an upgraded connection
+type wsConn struct {
+	conn net.Conn
+	br   *bufio.Reader
+	// maxMessage is the largest message a client may send
+	maxMessage int64
+	// readTimeout is how long the peer may stay silent, pings included
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+
+	writeMu   sync.Mutex
+	closeSent bool
+	closing   atomic.Bool
+}
+
+func wsAcceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// headerHasToken reports whether a comma separated header contains token
+func headerHasToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// upgradeWebSocket performs the handshake and takes over the connection.
+// On failure it has already responded.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	if r.Method != http.MethodGet {
+		respondWithError(w, http.StatusMethodNotAllowed, "WebSocket upgrades must use GET")
+		return nil, errors.New("bad method")
+	}
+	if !headerHasToken(r.Header, "Connection", "upgrade") || !headerHasToken(r.Header, "Upgrade", "websocket") {
+		w.Header().Set("Upgrade", "websocket")
+		respondWithError(w, http.StatusUpgradeRequired, "Expected a WebSocket upgrade")
+		return nil, errors.New("not an upgrade")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		respondWithError(w, http.StatusUpgradeRequired, "Unsupported WebSocket version")
+		return nil, errors.New("bad version")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		respondWithError(w, http.StatusBadRequest, "Invalid Sec-WebSocket-Key")
+		return nil, errors.New("bad key")
+	}
+
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "WebSocket upgrade not supported")
+		return nil, err
+	}
+	// the server's timeouts no longer apply, the connection manages its own
+	conn.SetDeadline(time.Time{})
+
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + wsAcceptKey(key) + "\r\n\r\n"
+	conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	if _, err := conn.Write([]byte(response)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &wsConn{
+		conn:         conn,
+		br:           brw.Reader,
+		maxMessage:   wsMaxMessageBytes,
+		readTimeout:  wsReadTimeout,
+		writeTimeout: wsWriteTimeout,
+	}, nil
+}
+
+// writeFrame sends one unfragmented, unmasked frame
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	// nothing may follow a close frame
+	if c.closeSent {
+		return errWSClosed
+	}
+	if opcode == wsOpClose {
+		c.closeSent = true
+	}
+
+	header := make([]byte, 2, 10)
+	header[0] = 0x80 | opcode
+	switch length := len(payload); {
+	case length <= 125:
+		header[1] = byte(length)
+	case length <= 0xFFFF:
+		header[1] = 126
+		header = binary.BigEndian.AppendUint16(header, uint16(length))
+	default:
+		header[1] = 127
+		header = binary.BigEndian.AppendUint64(header, uint64(length))
+	}
+
+	c.conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	if _, err := c.conn.Write(append(header, payload...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// WriteText sends a text message
+func (c *wsConn) WriteText(data []byte) error {
+	return c.writeFrame(wsOpText, data)
+}
+
+// Ping sends a ping, the peer answers with a pong
+func (c *wsConn) Ping() error {
+	return c.writeFrame(wsOpPing, nil)
+}
+
+// Close starts the closing handshake. The reader sees the peer's close
+// frame, or times out waiting for it, and then the connection is dropped.
+func (c *wsConn) Close(code int, reason string) error {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	payload = append(payload, reason...)
+	err := c.writeFrame(wsOpClose, payload)
+	if c.closing.CompareAndSwap(false, true) {
+		c.conn.SetReadDeadline(time.Now().Add(wsCloseTimeout))
+	}
+	return err
+}
+
+// Teardown closes the underlying connection without a handshake
+func (c *wsConn) Teardown() error {
+	return c.conn.Close()
+}
+
+// readFrame reads one frame and unmasks it
+func (c *wsConn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	if !c.closing.Load() {
+		c.conn.SetReadDeadline(time.Now().Add(c.readTimeout))
+	}
+
+	var header [2]byte
+	if _, err := io.ReadFull(c.br, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin = header[0]&0x80 != 0
+	opcode = header[0] & 0x0F
+	if header[0]&0x70 != 0 {
+		return false, 0, nil, &wsCloseError{wsCloseProtocolError, "reserved bits set"}
+	}
+	if header[1]&0x80 == 0 {
+		return false, 0, nil, &wsCloseError{wsCloseProtocolError, "client frames must be masked"}
+	}
+
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if opcode >= wsOpClose && (!fin || length > 125) {
+		return false, 0, nil, &wsCloseError{wsCloseProtocolError, "invalid control frame"}
+	}
+	if length > uint64(c.maxMessage) {
+		return false, 0, nil, &wsCloseError{wsCloseTooBig, "message too big"}
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(c.br, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+	payload = make([]byte, length)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, opcode, payload, nil
+}
+
+// ReadMessage returns the next complete message, answering pings along
+// the way. It also handles the closing handshake: when the peer closes,
+// or sends something invalid, the close frame has been sent by the time
+// the *wsCloseError comes back.
+func (c *wsConn) ReadMessage() (opcode byte, message []byte, err error) {
+	for {
+		fin, op, payload, err := c.readFrame()
+		if err != nil {
+			var closeErr *wsCloseError
+			if errors.As(err, &closeErr) {
+				c.Close(closeErr.Code, closeErr.Reason)
+			}
+			return 0, nil, err
+		}
+
+		switch op {
+		case wsOpPing:
+			c.writeFrame(wsOpPong, payload)
+			continue
+		case wsOpPong:
+			continue
+		case wsOpClose:
+			closeErr := &wsCloseError{Code: wsCloseNoStatus}
+			if len(payload) >= 2 {
+				closeErr.Code = int(binary.BigEndian.Uint16(payload))
+				closeErr.Reason = string(payload[2:])
+			}
+			code := closeErr.Code
+			if code == wsCloseNoStatus {
+				code = wsCloseNormal
+			}
+			c.Close(code, "")
+			return 0, nil, closeErr
+		case wsOpContinuation:
+			if opcode == 0 {
+				return 0, nil, c.fail(wsCloseProtocolError, "unexpected continuation frame")
+			}
+		case wsOpText, wsOpBinary:
+			if opcode != 0 {
+				return 0, nil, c.fail(wsCloseProtocolError, "expected continuation frame")
+			}
+			opcode = op
+		default:
+			return 0, nil, c.fail(wsCloseProtocolError, "unknown opcode")
+		}
+
+		if int64(len(message)+len(payload)) > c.maxMessage {
+			return 0, nil, c.fail(wsCloseTooBig, "message too big")
+		}
+		message = append(message, payload...)
+		if !fin {
+			continue
+		}
+		if opcode == wsOpText && !utf8.Valid(message) {
+			return 0, nil, c.fail(wsCloseInvalidPayload, "invalid UTF-8")
+		}
+		return opcode, message, nil
+	}
+}
+
+// fail closes the connection because of something the peer sent
+func (c *wsConn) fail(code int, reason string) error {
+	c.Close(code, reason)
+	return &wsCloseError{code, reason}
+}
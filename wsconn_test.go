@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// wsFrame is a frame as seen on the wire
+type wsFrame struct {
+	fin     bool
+	opcode  byte
+	payload []byte
+}
+
+// encodeClientFrame builds a frame the way a client sends it
+func encodeClientFrame(f wsFrame, masked bool) []byte {
+	b0 := f.opcode
+	if f.fin {
+		b0 |= 0x80
+	}
+	frame := []byte{b0, 0}
+	switch length := len(f.payload); {
+	case length <= 125:
+		frame[1] = byte(length)
+	case length <= 0xFFFF:
+		frame[1] = 126
+		frame = binary.BigEndian.AppendUint16(frame, uint16(length))
+	default:
+		frame[1] = 127
+		frame = binary.BigEndian.AppendUint64(frame, uint64(length))
+	}
+	if !masked {
+		return append(frame, f.payload...)
+	}
+	frame[1] |= 0x80
+	mask := [4]byte{0x37, 0xfa, 0x21, 0x3d}
+	frame = append(frame, mask[:]...)
+	for i, b := range f.payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	return frame
+}
+
+// readServerFrame parses an unmasked frame
+func readServerFrame(r io.Reader) (wsFrame, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return wsFrame{}, err
+	}
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return wsFrame{}, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return wsFrame{}, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return wsFrame{}, err
+	}
+	return wsFrame{fin: header[0]&0x80 != 0, opcode: header[0] & 0x0F, payload: payload}, nil
+}
+
+// newTestWSConn connects a wsConn to a fake client. Frames the server
+// sends come out of the returned channel.
+func newTestWSConn(t *testing.T) (*wsConn, net.Conn, <-chan wsFrame) {
+	t.Helper()
+	server, client := net.Pipe()
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+
+	received := make(chan wsFrame, 16)
+	go func() {
+		defer close(received)
+		for {
+			frame, err := readServerFrame(client)
+			if err != nil {
+				return
+			}
+			received <- frame
+		}
+	}()
+
+	return &wsConn{
+		conn:         server,
+		br:           bufio.NewReader(server),
+		maxMessage:   1 << 20,
+		readTimeout:  time.Second,
+		writeTimeout: time.Second,
+	}, client, received
+}
+
+// sendFrames writes client frames without blocking the test, net.Pipe
+// writes wait for the reader
+func sendFrames(client net.Conn, masked bool, frames ...wsFrame) {
+	var buf bytes.Buffer
+	for _, f := range frames {
+		buf.Write(encodeClientFrame(f, masked))
+	}
+	go client.Write(buf.Bytes())
+}
+
+func nextServerFrame(t *testing.T, received <-chan wsFrame) wsFrame {
+	t.Helper()
+	select {
+	case frame, ok := <-received:
+		if !ok {
+			t.Fatal("connection closed before the server sent a frame")
+		}
+		return frame
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for a server frame")
+	}
+	return wsFrame{}
+}
+
+// expectClose checks the error from ReadMessage and the close frame the
+// server answered with
+func expectClose(t *testing.T, err error, received <-chan wsFrame, code int) {
+	t.Helper()
+	var closeErr *wsCloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != code {
+		t.Fatalf("got error %v, want close code %d", err, code)
+	}
+	frame := nextServerFrame(t, received)
+	if frame.opcode != wsOpClose || len(frame.payload) < 2 {
+		t.Fatalf("got frame %+v, want a close frame", frame)
+	}
+	if got := int(binary.BigEndian.Uint16(frame.payload)); got != code {
+		t.Fatalf("server closed with %d, want %d", got, code)
+	}
+}
+
+func TestWSAcceptKey(t *testing.T) {
+	// the example from RFC 6455 section 1.3
+	if got := wsAcceptKey("dGhlIHNhbXBsZSBub25jZQ=="); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("wsAcceptKey = %q", got)
+	}
+}
+
+func TestWSReadMaskedText(t *testing.T) {
+	conn, client, _ := newTestWSConn(t)
+	sendFrames(client, true, wsFrame{fin: true, opcode: wsOpText, payload: []byte("Hello")})
+
+	opcode, message, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opcode != wsOpText || string(message) != "Hello" {
+		t.Fatalf("got %d %q", opcode, message)
+	}
+}
+
+func TestWSRejectsUnmaskedFrame(t *testing.T) {
+	conn, client, received := newTestWSConn(t)
+	sendFrames(client, false, wsFrame{fin: true, opcode: wsOpText, payload: []byte("Hello")})
+
+	_, _, err := conn.ReadMessage()
+	expectClose(t, err, received, wsCloseProtocolError)
+}
+
+func TestWSExtendedLengths(t *testing.T) {
+	for _, size := range []int{125, 126, 200, 0xFFFF, 0x10000, 70000} {
+		conn, client, received := newTestWSConn(t)
+		payload := bytes.Repeat([]byte("a"), size)
+
+		sendFrames(client, true, wsFrame{fin: true, opcode: wsOpBinary, payload: payload})
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+		if !bytes.Equal(message, payload) {
+			t.Fatalf("%d bytes: read %d bytes back", size, len(message))
+		}
+
+		if err := conn.WriteText(payload); err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+		frame := nextServerFrame(t, received)
+		if !frame.fin || frame.opcode != wsOpText || !bytes.Equal(frame.payload, payload) {
+			t.Fatalf("%d bytes: client got %d bytes back", size, len(frame.payload))
+		}
+	}
+}
+
+func TestWSMessageTooBig(t *testing.T) {
+	conn, client, received := newTestWSConn(t)
+	conn.maxMessage = 100
+	sendFrames(client, true, wsFrame{fin: true, opcode: wsOpText, payload: bytes.Repeat([]byte("a"), 200)})
+
+	_, _, err := conn.ReadMessage()
+	expectClose(t, err, received, wsCloseTooBig)
+}
+
+func TestWSFragmentedTextWithPing(t *testing.T) {
+	conn, client, received := newTestWSConn(t)
+	sendFrames(client, true,
+		wsFrame{fin: false, opcode: wsOpText, payload: []byte("Hel")},
+		wsFrame{fin: true, opcode: wsOpPing, payload: []byte("are you there")},
+		wsFrame{fin: false, opcode: wsOpContinuation, payload: []byte("lo, ")},
+		wsFrame{fin: true, opcode: wsOpContinuation, payload: []byte("world")},
+	)
+
+	opcode, message, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opcode != wsOpText || string(message) != "Hello, world" {
+		t.Fatalf("got %d %q", opcode, message)
+	}
+	pong := nextServerFrame(t, received)
+	if pong.opcode != wsOpPong || string(pong.payload) != "are you there" {
+		t.Fatalf("got %+v, want the ping echoed in a pong", pong)
+	}
+}
+
+func TestWSCloseDuringFragmentation(t *testing.T) {
+	conn, client, received := newTestWSConn(t)
+	sendFrames(client, true,
+		wsFrame{fin: false, opcode: wsOpText, payload: []byte("Hel")},
+		wsFrame{fin: true, opcode: wsOpClose, payload: binary.BigEndian.AppendUint16(nil, wsCloseGoingAway)},
+	)
+
+	_, _, err := conn.ReadMessage()
+	var closeErr *wsCloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != wsCloseGoingAway {
+		t.Fatalf("got error %v, want the client's close", err)
+	}
+	// the half-read message is dropped and the close echoed
+	frame := nextServerFrame(t, received)
+	if frame.opcode != wsOpClose || len(frame.payload) < 2 || binary.BigEndian.Uint16(frame.payload) != wsCloseGoingAway {
+		t.Fatalf("got frame %+v, want the close echoed", frame)
+	}
+	if err := conn.WriteText([]byte("late")); !errors.Is(err, errWSClosed) {
+		t.Fatalf("writing after close: %v", err)
+	}
+}
+
+func TestWSFragmentationErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		frames []wsFrame
+	}{
+		{
+			name:   "continuation without a start",
+			frames: []wsFrame{{fin: true, opcode: wsOpContinuation, payload: []byte("x")}},
+		},
+		{
+			name: "new message inside a fragmented one",
+			frames: []wsFrame{
+				{fin: false, opcode: wsOpText, payload: []byte("a")},
+				{fin: true, opcode: wsOpText, payload: []byte("b")},
+			},
+		},
+		{
+			name:   "fragmented control frame",
+			frames: []wsFrame{{fin: false, opcode: wsOpPing, payload: []byte("p")}},
+		},
+		{
+			name:   "unknown opcode",
+			frames: []wsFrame{{fin: true, opcode: 0x3, payload: []byte("x")}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, client, received := newTestWSConn(t)
+			sendFrames(client, true, tt.frames...)
+			_, _, err := conn.ReadMessage()
+			expectClose(t, err, received, wsCloseProtocolError)
+		})
+	}
+}
+
+func TestWSInvalidUTF8(t *testing.T) {
+	conn, client, received := newTestWSConn(t)
+	sendFrames(client, true, wsFrame{fin: true, opcode: wsOpText, payload: []byte("bad \xff byte")})
+
+	_, _, err := conn.ReadMessage()
+	expectClose(t, err, received, wsCloseInvalidPayload)
+}
+
+func TestWSUTF8SplitAcrossFragments(t *testing.T) {
+	conn, client, _ := newTestWSConn(t)
+	// "é" is 0xC3 0xA9, each fragment alone is invalid
+	sendFrames(client, true,
+		wsFrame{fin: false, opcode: wsOpText, payload: []byte("caf\xc3")},
+		wsFrame{fin: true, opcode: wsOpContinuation, payload: []byte("\xa9")},
+	)
+
+	_, message, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(message) != "café" {
+		t.Fatalf("got %q", message)
+	}
+}